@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BackendConfig sets how Nisaba runs the llamafile or llama-server process
+// that serves the API endpoint.
+type BackendConfig struct {
+	Path           string   `json:"path"`
+	Model          string   `json:"model"`
+	Args           []string `json:"args"`
+	HealthURL      string   `json:"health_url"`
+	StartupTimeout int      `json:"startup_timeout"`
+	RestartDelay   int      `json:"restart_delay"`
+	MaxRestarts    int      `json:"max_restarts"`
+	LogFile        string   `json:"log_file"`
+}
+
+// defaultBackendArgs are used when "args" is not set and there is no
+// "llamafile_args.txt", matching the Docker image.
+var defaultBackendArgs = []string{"--nobrowser", "-ngl", "0"}
+
+// Supervisor starts the backend process, restarts it if it exits, and
+// reports whether it is ready to answer requests.
+type Supervisor struct {
+	config    *BackendConfig
+	args      []string
+	healthURL string
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	ready    bool
+	stopping bool
+}
+
+// NewSupervisor prepares the backend settings. The health URL defaults to
+// "/health" on the host of "api_url".
+func NewSupervisor(config *BackendConfig, apiURL string) (*Supervisor, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("the backend path is required")
+	}
+	args := config.Args
+	if args == nil {
+		args = defaultBackendArgs
+		if content, err := os.ReadFile(getConfigFilePath("llamafile_args.txt")); err == nil {
+			args = strings.Fields(string(content))
+		}
+	}
+	if config.Model != "" {
+		args = append([]string{"-m", config.Model}, args...)
+	}
+
+	healthURL := config.HealthURL
+	if healthURL == "" {
+		u, err := url.Parse(apiURL)
+		if err != nil {
+			return nil, err
+		}
+		healthURL = u.Scheme + "://" + u.Host + "/health"
+	}
+	return &Supervisor{config: config, args: args, healthURL: healthURL}, nil
+}
+
+// Ready reports whether the backend has passed its health check since it
+// was last started.
+func (s *Supervisor) Ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+// Start runs the backend and keeps it running until Stop is called.
+func (s *Supervisor) Start() {
+	go s.run()
+}
+
+func (s *Supervisor) run() {
+	restarts := 0
+	for {
+		started := time.Now()
+		if err := s.startProcess(); err != nil {
+			slog.Error("Error starting backend", "path", s.config.Path, "error", err)
+		} else {
+			go s.waitHealthy()
+			err := s.wait()
+			if s.isStopping() {
+				return
+			}
+			slog.Error("Backend exited", "error", err, "uptime", time.Since(started).Round(time.Second).String())
+		}
+
+		// A backend that ran for a while before failing gets a fresh set
+		// of restarts, so "max_restarts" only stops a crash loop.
+		if time.Since(started) > 10*time.Minute {
+			restarts = 0
+		}
+		restarts++
+		if s.config.MaxRestarts > 0 && restarts > s.config.MaxRestarts {
+			slog.Error("Backend restarted too many times, giving up", "restarts", s.config.MaxRestarts)
+			return
+		}
+		time.Sleep(time.Duration(s.config.RestartDelay) * time.Second)
+		if s.isStopping() {
+			return
+		}
+		slog.Info("Restarting backend", "attempt", restarts)
+	}
+}
+
+func (s *Supervisor) startProcess() error {
+	cmd := exec.Command(s.config.Path, s.args...)
+	cmd.SysProcAttr = backendProcAttr()
+	output, err := s.logWriter()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return fmt.Errorf("shutting down")
+	}
+	slog.Info("Starting backend", "path", s.config.Path, "args", strings.Join(s.args, " "))
+	if err := cmd.Start(); err != nil {
+		output.Close()
+		return err
+	}
+	s.cmd = cmd
+	s.ready = false
+	s.exited = make(chan struct{})
+	go func() {
+		// Close the log once the process and its output are done.
+		cmd.Wait()
+		output.Close()
+		s.mu.Lock()
+		s.ready = false
+		close(s.exited)
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+// wait blocks until the running process exits.
+func (s *Supervisor) wait() error {
+	s.mu.Lock()
+	cmd, exited := s.cmd, s.exited
+	s.mu.Unlock()
+	<-exited
+	if cmd.ProcessState != nil && !cmd.ProcessState.Success() {
+		return fmt.Errorf("%s", cmd.ProcessState)
+	}
+	return nil
+}
+
+func (s *Supervisor) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping
+}
+
+// logWriter returns where the backend's output goes: "log_file" if set,
+// otherwise Nisaba's log at debug level, one line at a time.
+func (s *Supervisor) logWriter() (io.WriteCloser, error) {
+	if s.config.LogFile != "" {
+		return os.OpenFile(s.config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			slog.Debug("Backend output", "line", scanner.Text())
+		}
+		reader.Close()
+	}()
+	return writer, nil
+}
+
+// waitHealthy polls the health URL until the backend answers, which takes
+// as long as loading the model.
+func (s *Supervisor) waitHealthy() {
+	s.mu.Lock()
+	exited := s.exited
+	s.mu.Unlock()
+	deadline := time.Now().Add(time.Duration(s.config.StartupTimeout) * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			return
+		case <-time.After(time.Second):
+		}
+		if err := checkHealth(context.Background(), s.healthURL, ""); err == nil {
+			s.mu.Lock()
+			select {
+			case <-exited:
+			default:
+				s.ready = true
+			}
+			s.mu.Unlock()
+			slog.Info("Backend is ready", "health_url", s.healthURL)
+			return
+		}
+	}
+	slog.Error("Backend did not become ready, restarting it", "timeout", s.config.StartupTimeout)
+	s.signal(syscall.SIGKILL)
+}
+
+func (s *Supervisor) signal(sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Signal(sig)
+	}
+}
+
+// Stop ends the backend, killing it if it has not exited after ten seconds.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	s.stopping = true
+	exited := s.exited
+	s.mu.Unlock()
+	if exited == nil {
+		return
+	}
+
+	slog.Info("Stopping backend")
+	s.signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		slog.Warn("Backend did not stop, killing it")
+		s.signal(syscall.SIGKILL)
+		<-exited
+	}
+}
+
+// checkHealth reports whether url answers with a success status. The API
+// key is sent if given, for endpoints that need it.
+func checkHealth(ctx context.Context, url, apiKey string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
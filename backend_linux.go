@@ -0,0 +1,10 @@
+package main
+
+import "syscall"
+
+// backendProcAttr runs the backend in its own process group, so signals
+// sent to Nisaba's terminal reach it only through Stop, and has the kernel
+// stop it if Nisaba exits without doing so.
+func backendProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM, Setpgid: true}
+}
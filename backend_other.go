@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// backendProcAttr has no process settings outside Linux, where the backend
+// is only stopped by Stop.
+func backendProcAttr() *syscall.SysProcAttr {
+	return nil
+}
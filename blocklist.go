@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/thoj/go-ircevent"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sender identifies who sent a message, for matching against the block
+// list, the allow list and "admins".
+type Sender struct {
+	Nick    string
+	User    string
+	Host    string
+	Account string
+}
+
+// senderFromEvent reads the services account from the IRCv3 "account" tag,
+// which is only sent by servers supporting the "account-tag" capability.
+func senderFromEvent(e *irc.Event) Sender {
+	return Sender{Nick: e.Nick, User: e.User, Host: e.Host, Account: e.Tags["account"]}
+}
+
+// accessEntry is a line of "blocklist.txt" or "allowlist.txt":
+//
+//	<mask> [<expiry>|-] [<reason>]
+//
+// The mask is a nickname, a "nick!user@host" hostmask, or "$a:account",
+// and may contain the wildcards "*" and "?". The expiry is in RFC 3339
+// format, or "-" for an entry that never expires.
+type accessEntry struct {
+	Mask    string
+	Expires time.Time
+	Reason  string
+}
+
+func parseAccessEntry(line string) (accessEntry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return accessEntry{}, false
+	}
+	entry := accessEntry{Mask: fields[0]}
+	rest := fields[1:]
+	if len(rest) > 0 {
+		if rest[0] == "-" {
+			rest = rest[1:]
+		} else if expires, err := time.Parse(time.RFC3339, rest[0]); err == nil {
+			entry.Expires = expires
+			rest = rest[1:]
+		}
+	}
+	entry.Reason = strings.Join(rest, " ")
+	return entry, true
+}
+
+func (entry accessEntry) String() string {
+	if entry.Expires.IsZero() && entry.Reason == "" {
+		return entry.Mask
+	}
+	expires := "-"
+	if !entry.Expires.IsZero() {
+		expires = entry.Expires.Format(time.RFC3339)
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", entry.Mask, expires, entry.Reason))
+}
+
+func (entry accessEntry) expired(now time.Time) bool {
+	return !entry.Expires.IsZero() && !now.Before(entry.Expires)
+}
+
+func (entry accessEntry) matches(s Sender) bool {
+	mask := strings.ToLower(entry.Mask)
+	switch {
+	case strings.HasPrefix(mask, "$a:"):
+		return s.Account != "" && globMatch(mask[len("$a:"):], strings.ToLower(s.Account))
+	case strings.ContainsAny(mask, "!@"):
+		return globMatch(mask, strings.ToLower(fmt.Sprintf("%s!%s@%s", s.Nick, s.User, s.Host)))
+	default:
+		return globMatch(mask, strings.ToLower(s.Nick))
+	}
+}
+
+// globMatch matches IRC style wildcards. path.Match is not used as "[" and
+// "\" are valid in nicknames.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func matchesAny(entries []accessEntry, s Sender, now time.Time) (accessEntry, bool) {
+	for _, entry := range entries {
+		if !entry.expired(now) && entry.matches(s) {
+			return entry, true
+		}
+	}
+	return accessEntry{}, false
+}
+
+// accessLists are the block and allow lists of a profile.
+type accessLists struct {
+	blocked []accessEntry
+	allowed []accessEntry
+}
+
+var (
+	accessMu sync.Mutex
+	// accessCache holds the lists of each profile, keyed by profile name
+	// with "" for the default configuration, loaded on first use.
+	accessCache = make(map[string]*accessLists)
+)
+
+func loadAccessList(profile, fileName string) []accessEntry {
+	file, err := os.Open(getProfileConfigFilePath(profile, fileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Error opening access list file", "file", fileName, "error", err)
+		}
+		return nil
+	}
+	defer file.Close()
+
+	var entries []accessEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if entry, ok := parseAccessEntry(scanner.Text()); ok {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Warn("Error reading access list file", "file", fileName, "error", err)
+	}
+	return entries
+}
+
+// profileAccessLists returns the lists of a profile, loading them if they
+// are not cached. Must be called with accessMu held.
+func profileAccessLists(profile string) *accessLists {
+	lists, ok := accessCache[profile]
+	if !ok {
+		lists = &accessLists{
+			blocked: loadAccessList(profile, "blocklist.txt"),
+			allowed: loadAccessList(profile, "allowlist.txt"),
+		}
+		accessCache[profile] = lists
+	}
+	return lists
+}
+
+// reloadAccessLists drops the cached lists of a profile, so they are read
+// again when next used.
+func reloadAccessLists(profile string) {
+	accessMu.Lock()
+	delete(accessCache, profile)
+	accessMu.Unlock()
+}
+
+// saveBlockList writes the block list of a profile, dropping expired
+// entries. Must be called with accessMu held.
+func saveBlockList(profile string, lists *accessLists) error {
+	now := time.Now()
+	var sb strings.Builder
+	var kept []accessEntry
+	for _, entry := range lists.blocked {
+		if entry.expired(now) {
+			continue
+		}
+		kept = append(kept, entry)
+		sb.WriteString(entry.String() + "\n")
+	}
+	lists.blocked = kept
+	return os.WriteFile(getProfileDataFilePath(profile, "blocklist.txt"), []byte(sb.String()), 0644)
+}
+
+// addBlock adds an entry to the block list of a profile, replacing any
+// entry with the same mask.
+func addBlock(profile string, entry accessEntry) error {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	lists := profileAccessLists(profile)
+	for i, existing := range lists.blocked {
+		if strings.EqualFold(existing.Mask, entry.Mask) {
+			lists.blocked = append(lists.blocked[:i], lists.blocked[i+1:]...)
+			break
+		}
+	}
+	lists.blocked = append(lists.blocked, entry)
+	return saveBlockList(profile, lists)
+}
+
+// removeBlock removes an entry from the block list of a profile, reporting
+// whether it existed.
+func removeBlock(profile, mask string) (bool, error) {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	lists := profileAccessLists(profile)
+	for i, existing := range lists.blocked {
+		if strings.EqualFold(existing.Mask, mask) {
+			lists.blocked = append(lists.blocked[:i], lists.blocked[i+1:]...)
+			return true, saveBlockList(profile, lists)
+		}
+	}
+	return false, nil
+}
+
+func activeBlocks(profile string) []accessEntry {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	now := time.Now()
+	var entries []accessEntry
+	for _, entry := range profileAccessLists(profile).blocked {
+		if !entry.expired(now) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// validAdminMask reports whether mask can identify an admin: a hostmask or
+// a services account. A bare nickname can be taken by anyone while services
+// are not enforcing it, so it is not enough.
+func validAdminMask(mask string) bool {
+	return strings.HasPrefix(strings.ToLower(mask), "$a:") || strings.ContainsAny(mask, "!@")
+}
+
+func (bot *Bot) isAdmin(s Sender) bool {
+	for _, mask := range bot.Config.Admins {
+		if (accessEntry{Mask: mask}).matches(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlocked reports whether messages from s should be ignored, using the
+// lists of the conversation's profile. Admins are never blocked. With
+// "allowlist_only" set, anyone not on the allow list is.
+func (bot *Bot) isBlocked(conv *Conversation, s Sender) bool {
+	if bot.isAdmin(s) {
+		return false
+	}
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	lists := profileAccessLists(conv.Profile)
+	now := time.Now()
+	if _, blocked := matchesAny(lists.blocked, s, now); blocked {
+		return true
+	}
+	if *bot.Config.AllowlistOnly {
+		_, allowed := matchesAny(lists.allowed, s, now)
+		return !allowed
+	}
+	return false
+}
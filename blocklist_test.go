@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*", "a", true},
+		{"*c", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"*!*@*.example.com", "nick!user@host.example.com", true},
+		{"*!*@*.example.com", "nick!user@example.com", false},
+		{"*!*@*.example.com", "nick!user@host.example.com.evil", false},
+		{"*a*b*", "xxaxxbxx", true},
+		{"*a*b", "ab_a_b_a", false},
+		{"nick[away]", "nick[away]", true},
+		{`nick\`, `nick\`, true},
+		{"**", "abc", true},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseAccessEntry(t *testing.T) {
+	expires := time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		line string
+		want accessEntry
+		ok   bool
+	}{
+		{"", accessEntry{}, false},
+		{"   ", accessEntry{}, false},
+		{"# comment", accessEntry{}, false},
+		{"spammer", accessEntry{Mask: "spammer"}, true},
+		{"*!*@bad.host - flooding the channel", accessEntry{Mask: "*!*@bad.host", Reason: "flooding the channel"}, true},
+		{"$a:troll 2030-01-02T03:04:05Z spam", accessEntry{Mask: "$a:troll", Expires: expires, Reason: "spam"}, true},
+		{"nick 2030-01-02T03:04:05Z", accessEntry{Mask: "nick", Expires: expires}, true},
+		{"nick tomorrow maybe", accessEntry{Mask: "nick", Reason: "tomorrow maybe"}, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseAccessEntry(tt.line)
+		if ok != tt.ok || got.Mask != tt.want.Mask || !got.Expires.Equal(tt.want.Expires) || got.Reason != tt.want.Reason {
+			t.Errorf("parseAccessEntry(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAccessEntryRoundTrip(t *testing.T) {
+	for _, line := range []string{
+		"nick",
+		"*!*@host - reason here",
+		"$a:account 2030-01-02T03:04:05Z",
+		"$a:account 2030-01-02T03:04:05Z some reason",
+	} {
+		entry, ok := parseAccessEntry(line)
+		if !ok {
+			t.Fatalf("parseAccessEntry(%q) failed", line)
+		}
+		if got := entry.String(); got != line {
+			t.Errorf("parseAccessEntry(%q).String() = %q", line, got)
+		}
+	}
+}
+
+func TestAccessEntryMatches(t *testing.T) {
+	sender := Sender{Nick: "Alice", User: "~alice", Host: "host.example.com", Account: "AliceAcct"}
+	guest := Sender{Nick: "alice", User: "guest", Host: "other.net"}
+	tests := []struct {
+		mask   string
+		sender Sender
+		want   bool
+	}{
+		{"alice", sender, true},
+		{"ALI*", sender, true},
+		{"bob", sender, false},
+		{"*!*@host.example.com", sender, true},
+		{"*!*@*.EXAMPLE.com", sender, true},
+		{"*!~alice@*", sender, true},
+		{"*!*@host.example.com", guest, false},
+		{"$a:aliceacct", sender, true},
+		{"$a:alice*", sender, true},
+		{"$a:aliceacct", guest, false},
+		{"$a:*", guest, false},
+	}
+	for _, tt := range tests {
+		if got := (accessEntry{Mask: tt.mask}).matches(tt.sender); got != tt.want {
+			t.Errorf("%q matches %+v = %v, want %v", tt.mask, tt.sender, got, tt.want)
+		}
+	}
+}
+
+func TestAccessEntryExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		expires time.Time
+		want    bool
+	}{
+		{time.Time{}, false},
+		{now.Add(time.Hour), false},
+		{now, true},
+		{now.Add(-time.Hour), true},
+	}
+	for _, tt := range tests {
+		if got := (accessEntry{Mask: "x", Expires: tt.expires}).expired(now); got != tt.want {
+			t.Errorf("expired with expiry %v = %v, want %v", tt.expires, got, tt.want)
+		}
+	}
+}
+
+func TestValidAdminMask(t *testing.T) {
+	tests := []struct {
+		mask string
+		want bool
+	}{
+		{"alice", false},
+		{"ali*", false},
+		{"*!*@trusted.host", true},
+		{"alice!*@*", true},
+		{"*@trusted.host", true},
+		{"$a:alice", true},
+		{"$A:alice", true},
+	}
+	for _, tt := range tests {
+		if got := validAdminMask(tt.mask); got != tt.want {
+			t.Errorf("validAdminMask(%q) = %v, want %v", tt.mask, got, tt.want)
+		}
+	}
+}
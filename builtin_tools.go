@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Built-in tools work offline, so they can be enabled on any deployment.
+
+func init() {
+	registerTool(&Tool{
+		Name:        "calculator",
+		Description: "Evaluate an arithmetic expression. Supports + - * / % ^, parentheses, the constants pi and e, and the functions sqrt, abs, sin, cos, tan, asin, acos, atan, ln, log, log2, exp, floor, ceil and round.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {"expression": {"type": "string", "description": "The expression to evaluate, e.g. \"(2 + 3) * sqrt(16)\"."}},
+			"required": ["expression"]
+		}`),
+		Run: runCalculator,
+	})
+	registerTool(&Tool{
+		Name:        "current_time",
+		Description: "Get the current date and time in a time zone.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {"timezone": {"type": "string", "description": "IANA time zone name such as \"Europe/Berlin\", defaults to UTC."}}
+		}`),
+		Run: runCurrentTime,
+	})
+	registerTool(&Tool{
+		Name:        "convert_units",
+		Description: "Convert a value between units of length, mass, volume, time, speed, data size or temperature.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"value": {"type": "number"},
+				"from": {"type": "string", "description": "Unit to convert from, e.g. \"km\", \"lb\", \"F\"."},
+				"to": {"type": "string", "description": "Unit to convert to, e.g. \"mi\", \"kg\", \"C\"."}
+			},
+			"required": ["value", "from", "to"]
+		}`),
+		Run: runConvertUnits,
+	})
+	registerTool(&Tool{
+		Name:        "search_history",
+		Description: "Search the bot's stored conversation history and saved history archives for messages containing some text.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"query": {"type": "string", "description": "Text to search for, case insensitive."},
+				"limit": {"type": "integer", "description": "Maximum number of matches to return, defaults to 5."}
+			},
+			"required": ["query"]
+		}`),
+		Run: runSearchHistory,
+	})
+}
+
+func runCalculator(ctx context.Context, conv *Conversation, args json.RawMessage) (string, error) {
+	var params struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+	result, err := evaluateExpression(params.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(result, 'g', 15, 64), nil
+}
+
+// exprParser is a recursive descent parser for arithmetic expressions:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = unary { ("*" | "/" | "%") unary }
+//	unary  = ("-" | "+") unary | power
+//	power  = atom [ "^" unary ]
+//	atom   = number | name | name "(" expr ")" | "(" expr ")"
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func evaluateExpression(input string) (float64, error) {
+	p := &exprParser{input: input}
+	value, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected '%c' at position %d", p.input[p.pos], p.pos+1)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("result is not a finite number")
+	}
+	return value, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) expr() (float64, error) {
+	left, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			left += right
+		} else {
+			left -= right
+		}
+	}
+}
+
+func (p *exprParser) term() (float64, error) {
+	left, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			left *= right
+		case '/':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left /= right
+		case '%':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left = math.Mod(left, right)
+		}
+	}
+}
+
+func (p *exprParser) unary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		value, err := p.unary()
+		return -value, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *exprParser) power() (float64, error) {
+	base, err := p.atom()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() == '^' {
+		p.pos++
+		exponent, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(base, exponent), nil
+	}
+	return base, nil
+}
+
+var exprFunctions = map[string]func(float64) float64{
+	"sqrt":  math.Sqrt,
+	"abs":   math.Abs,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"asin":  math.Asin,
+	"acos":  math.Acos,
+	"atan":  math.Atan,
+	"ln":    math.Log,
+	"log":   math.Log10,
+	"log2":  math.Log2,
+	"exp":   math.Exp,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"round": math.Round,
+}
+
+var exprConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+func (p *exprParser) atom() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		value, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return value, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		// Allow an exponent such as 1.5e3.
+		if p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+			end := p.pos + 1
+			if end < len(p.input) && (p.input[end] == '+' || p.input[end] == '-') {
+				end++
+			}
+			if end < len(p.input) && p.input[end] >= '0' && p.input[end] <= '9' {
+				for end < len(p.input) && p.input[end] >= '0' && p.input[end] <= '9' {
+					end++
+				}
+				p.pos = end
+			}
+		}
+		return strconv.ParseFloat(p.input[start:p.pos], 64)
+	case unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos]))) {
+			p.pos++
+		}
+		name := strings.ToLower(p.input[start:p.pos])
+		if value, ok := exprConstants[name]; ok {
+			return value, nil
+		}
+		fn, ok := exprFunctions[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown name '%s'", name)
+		}
+		if p.peek() != '(' {
+			return 0, fmt.Errorf("function '%s' requires parentheses", name)
+		}
+		arg, err := p.atom()
+		if err != nil {
+			return 0, err
+		}
+		return fn(arg), nil
+	case c == 0:
+		return 0, fmt.Errorf("unexpected end of expression")
+	}
+	return 0, fmt.Errorf("unexpected '%c' at position %d", c, p.pos+1)
+}
+
+func runCurrentTime(ctx context.Context, conv *Conversation, args json.RawMessage) (string, error) {
+	var params struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+	if params.Timezone == "" {
+		params.Timezone = "UTC"
+	}
+	location, err := time.LoadLocation(params.Timezone)
+	if err != nil {
+		return "", fmt.Errorf("unknown time zone '%s'", params.Timezone)
+	}
+	return time.Now().In(location).Format("Monday, 2 January 2006 15:04:05 MST (-07:00)"), nil
+}
+
+type unit struct {
+	dimension string
+	factor    float64 // multiplier to the base unit of the dimension
+}
+
+var units = map[string]unit{
+	"m": {"length", 1}, "km": {"length", 1000}, "cm": {"length", 0.01}, "mm": {"length", 0.001},
+	"mi": {"length", 1609.344}, "yd": {"length", 0.9144}, "ft": {"length", 0.3048}, "in": {"length", 0.0254},
+	"nmi": {"length", 1852},
+
+	"kg": {"mass", 1}, "g": {"mass", 0.001}, "mg": {"mass", 1e-6}, "t": {"mass", 1000},
+	"lb": {"mass", 0.45359237}, "oz": {"mass", 0.028349523125}, "st": {"mass", 6.35029318},
+
+	"l": {"volume", 1}, "ml": {"volume", 0.001}, "m3": {"volume", 1000}, "gal": {"volume", 3.785411784},
+	"qt": {"volume", 0.946352946}, "pt": {"volume", 0.473176473}, "cup": {"volume", 0.2365882365},
+	"floz": {"volume", 0.0295735295625}, "tbsp": {"volume", 0.01478676478125}, "tsp": {"volume", 0.00492892159375},
+
+	"s": {"time", 1}, "ms": {"time", 0.001}, "min": {"time", 60}, "h": {"time", 3600},
+	"day": {"time", 86400}, "week": {"time", 604800}, "year": {"time", 31557600},
+
+	"m/s": {"speed", 1}, "km/h": {"speed", 1000.0 / 3600}, "mph": {"speed", 0.44704}, "kn": {"speed", 1852.0 / 3600},
+
+	"b": {"data", 1}, "kb": {"data", 1e3}, "mb": {"data", 1e6}, "gb": {"data", 1e9}, "tb": {"data", 1e12},
+	"kib": {"data", 1 << 10}, "mib": {"data", 1 << 20}, "gib": {"data", 1 << 30}, "tib": {"data", 1 << 40},
+}
+
+var unitAliases = map[string]string{
+	"meter": "m", "meters": "m", "metre": "m", "metres": "m", "kilometer": "km", "kilometers": "km",
+	"centimeter": "cm", "centimeters": "cm", "millimeter": "mm", "millimeters": "mm",
+	"mile": "mi", "miles": "mi", "yard": "yd", "yards": "yd", "foot": "ft", "feet": "ft", "inch": "in", "inches": "in",
+	"kilogram": "kg", "kilograms": "kg", "gram": "g", "grams": "g", "tonne": "t", "tonnes": "t",
+	"lbs": "lb", "pound": "lb", "pounds": "lb", "ounce": "oz", "ounces": "oz", "stone": "st",
+	"liter": "l", "liters": "l", "litre": "l", "litres": "l", "milliliter": "ml", "milliliters": "ml",
+	"gallon": "gal", "gallons": "gal", "quart": "qt", "quarts": "qt", "pint": "pt", "pints": "pt", "cups": "cup",
+	"sec": "s", "second": "s", "seconds": "s", "minute": "min", "minutes": "min", "hr": "h", "hour": "h", "hours": "h",
+	"days": "day", "weeks": "week", "years": "year", "kph": "km/h", "knots": "kn",
+	"byte": "b", "bytes": "b",
+	"c": "celsius", "°c": "celsius", "f": "fahrenheit", "°f": "fahrenheit", "k": "kelvin",
+}
+
+func normalizeUnit(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := unitAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+func toKelvin(value float64, scale string) (float64, bool) {
+	switch scale {
+	case "celsius":
+		return value + 273.15, true
+	case "fahrenheit":
+		return (value-32)*5/9 + 273.15, true
+	case "kelvin":
+		return value, true
+	}
+	return 0, false
+}
+
+func fromKelvin(value float64, scale string) float64 {
+	switch scale {
+	case "celsius":
+		return value - 273.15
+	case "fahrenheit":
+		return (value-273.15)*9/5 + 32
+	}
+	return value
+}
+
+func runConvertUnits(ctx context.Context, conv *Conversation, args json.RawMessage) (string, error) {
+	var params struct {
+		Value float64 `json:"value"`
+		From  string  `json:"from"`
+		To    string  `json:"to"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+	from, to := normalizeUnit(params.From), normalizeUnit(params.To)
+
+	var result float64
+	if kelvin, ok := toKelvin(params.Value, from); ok {
+		if _, ok := toKelvin(0, to); !ok {
+			return "", fmt.Errorf("cannot convert temperature to '%s'", params.To)
+		}
+		result = fromKelvin(kelvin, to)
+	} else {
+		fromUnit, ok := units[from]
+		if !ok {
+			return "", fmt.Errorf("unknown unit '%s'", params.From)
+		}
+		toUnit, ok := units[to]
+		if !ok {
+			return "", fmt.Errorf("unknown unit '%s'", params.To)
+		}
+		if fromUnit.dimension != toUnit.dimension {
+			return "", fmt.Errorf("cannot convert %s to %s", fromUnit.dimension, toUnit.dimension)
+		}
+		result = params.Value * fromUnit.factor / toUnit.factor
+	}
+	return fmt.Sprintf("%s %s = %s %s", strconv.FormatFloat(params.Value, 'g', 10, 64), params.From,
+		strconv.FormatFloat(result, 'g', 10, 64), params.To), nil
+}
+
+func runSearchHistory(ctx context.Context, conv *Conversation, args json.RawMessage) (string, error) {
+	var params struct {
+		Query string `json:"query"`
+		Limit int    `json:"limit"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(params.Query) == "" {
+		return "", fmt.Errorf("query must not be empty")
+	}
+	if params.Limit <= 0 || params.Limit > 20 {
+		params.Limit = 5
+	}
+
+	// Search the current history first, then archives from newest to oldest.
+	basePath := conv.historyFilePath()
+	extension := filepath.Ext(basePath)
+	archives, _ := filepath.Glob(strings.TrimSuffix(basePath, extension) + ".*" + extension)
+	sort.Slice(archives, func(i, j int) bool {
+		return archiveIndex(archives[i]) > archiveIndex(archives[j])
+	})
+	files := append([]string{basePath}, archives...)
+
+	query := strings.ToLower(params.Query)
+	var matches []string
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var history []Message
+		if err := json.Unmarshal(content, &history); err != nil {
+			continue
+		}
+		for _, msg := range history {
+			if msg.Role != "user" && msg.Role != "assistant" {
+				continue
+			}
+			if strings.Contains(strings.ToLower(msg.Content), query) {
+				matches = append(matches, fmt.Sprintf("[%s] %s: %s", filepath.Base(file), msg.Role, snippet(msg.Content, query, 300)))
+				if len(matches) >= params.Limit {
+					return strings.Join(matches, "\n"), nil
+				}
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return "No matching messages found.", nil
+	}
+	return strings.Join(matches, "\n"), nil
+}
+
+// archiveIndex returns N from an archive named like "history.N.txt".
+func archiveIndex(path string) int {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	index, _ := strconv.Atoi(strings.TrimPrefix(filepath.Ext(name), "."))
+	return index
+}
+
+// snippet returns up to size bytes of content around the first match of query.
+func snippet(content, query string, size int) string {
+	if len(content) <= size {
+		return content
+	}
+	start := strings.Index(strings.ToLower(content), query) - size/2
+	if start < 0 {
+		start = 0
+	}
+	if start+size > len(content) {
+		start = len(content) - size
+	}
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+	end := start + size
+	for end < len(content) && !utf8.RuneStart(content[end]) {
+		end++
+	}
+
+	result := content[start:end]
+	if start > 0 {
+		result = "..." + result
+	}
+	if end < len(content) {
+		result += "..."
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    float64
+		wantErr bool
+	}{
+		{"1 + 2", 3, false},
+		{"2 + 3 * 4", 14, false},
+		{"(2 + 3) * 4", 20, false},
+		{"10 - 4 - 3", 3, false},
+		{"8 / 4 / 2", 1, false},
+		{"7 % 3", 1, false},
+		{"-2 ^ 2", -4, false},
+		{"2 ^ 3 ^ 2", 512, false},
+		{"2 ^ -1", 0.5, false},
+		{"--3", 3, false},
+		{"+4", 4, false},
+		{"1.5e3", 1500, false},
+		{"2E-2", 0.02, false},
+		{".5 + .25", 0.75, false},
+		{"sqrt(16)", 4, false},
+		{"SQRT(16) + abs(-2)", 6, false},
+		{"log(1000)", 3, false},
+		{"round(2.5)", 3, false},
+		{"pi", math.Pi, false},
+		{"2e", 0, true},
+		{"1 / 0", 0, true},
+		{"1 % 0", 0, true},
+		{"sqrt(-1)", 0, true},
+		{"10 ^ 400", 0, true},
+		{"(1 + 2", 0, true},
+		{"1 + 2)", 0, true},
+		{"1 +", 0, true},
+		{"", 0, true},
+		{"foo(1)", 0, true},
+		{"sqrt 4", 0, true},
+		{"1.2.3", 0, true},
+		{"1 $ 2", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := evaluateExpression(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("evaluateExpression(%q) error = %v, want error %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("evaluateExpression(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRunConvertUnits(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		want     string
+		wantErr  bool
+	}{
+		{1, "km", "m", "1 km = 1000 m", false},
+		{1, "mile", "km", "1 mile = 1.609344 km", false},
+		{2, "lbs", "kg", "2 lbs = 0.90718474 kg", false},
+		{1, "gal", "L", "1 gal = 3.785411784 L", false},
+		{90, "minutes", "h", "90 minutes = 1.5 h", false},
+		{1, "GiB", "MiB", "1 GiB = 1024 MiB", false},
+		{100, "°C", "F", "100 °C = 212 F", false},
+		{32, "fahrenheit", "celsius", "32 fahrenheit = 0 celsius", false},
+		{0, "K", "C", "0 K = -273.15 C", false},
+		{1, "kg", "m", "", true},
+		{1, "C", "m", "", true},
+		{1, "furlong", "m", "", true},
+		{1, "m", "cubit", "", true},
+	}
+	for _, tt := range tests {
+		args, _ := json.Marshal(map[string]interface{}{"value": tt.value, "from": tt.from, "to": tt.to})
+		got, err := runConvertUnits(context.Background(), nil, args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("convert %v %s to %s: error = %v, want error %v", tt.value, tt.from, tt.to, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("convert %v %s to %s = %q, want %q", tt.value, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
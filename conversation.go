@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conversation is a channel, or a direct message with a user, and the
+// profile selected for it. It is passed to everything that reads the
+// profile's files, options or history.
+//
+// A Conversation is not changed once created. Switching profile or options
+// replaces it, so a request in progress keeps the settings it started with.
+type Conversation struct {
+	// Target is the channel name, or the nickname for direct messages.
+	Target   string
+	Profile  string
+	Options  *Options
+	Settings ProfileSettings
+	// Model is sent in chat payloads if set, starting as the profile's
+	// default model.
+	Model string
+
+	// historyName is "history.txt" for the channel in config.json, so its
+	// history is where it was before channels had their own profiles.
+	historyName string
+}
+
+func isChannel(target string) bool {
+	return target != "" && strings.ContainsRune("#&+!", rune(target[0]))
+}
+
+func (conv *Conversation) isDirect() bool {
+	return !isChannel(conv.Target)
+}
+
+func (conv *Conversation) profileLabel() string {
+	if conv.Profile == "" {
+		return "default"
+	}
+	return conv.Profile
+}
+
+// profileDir returns the directory holding the profile's files.
+func (conv *Conversation) profileDir() string {
+	return getProfileDir(conv.Profile)
+}
+
+func (conv *Conversation) configFilePath(fileName string) string {
+	return getProfileConfigFilePath(conv.Profile, fileName)
+}
+
+func (conv *Conversation) dataFilePath(fileName string) string {
+	return getProfileDataFilePath(conv.Profile, fileName)
+}
+
+func getProfileDir(profile string) string {
+	if profile == "" {
+		return configDir
+	}
+	return filepath.Join("profiles", profile)
+}
+
+// getProfileDataDir returns the directory for files a profile writes at
+// runtime when "--data-dir" is set.
+func getProfileDataDir(profile string) string {
+	if profile == "" {
+		return dataDir
+	}
+	return filepath.Join(dataDir, "profiles", profile)
+}
+
+// getProfileDataFilePath returns where a file written at runtime is stored:
+// the data directory if one is set, otherwise the profile directory, the
+// config directory, or the working directory.
+func getProfileDataFilePath(profile, fileName string) string {
+	if dataDir != "" {
+		dir := getProfileDataDir(profile)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			slog.Warn("Error creating data directory", "directory", dir, "error", err)
+		}
+		return filepath.Join(dir, fileName)
+	}
+	if _, err := os.Stat(getProfileDir(profile)); err == nil {
+		return filepath.Join(getProfileDir(profile), fileName)
+	}
+	return fileName
+}
+
+func (conv *Conversation) historyFilePath() string {
+	return conv.dataFilePath(conv.historyName)
+}
+
+var historyNameRegexp = regexp.MustCompile(`[^a-z0-9#_-]`)
+
+// newConversation loads the options and settings of profile for target.
+func (bot *Bot) newConversation(target, profile string) *Conversation {
+	conv := &Conversation{Target: target, Profile: profile, historyName: "history.txt"}
+	if !strings.EqualFold(target, bot.Config.Channel) {
+		conv.historyName = fmt.Sprintf("history-%s.txt", historyNameRegexp.ReplaceAllString(strings.ToLower(target), "_"))
+	}
+	options, err := loadOptions(conv, "options.json")
+	if err != nil {
+		slog.Debug("No options loaded", "target", target, "profile", conv.profileLabel(), "error", err)
+	}
+	conv.Options = options
+	conv.Settings = loadProfileSettings(conv)
+	conv.Model = conv.Settings.Model
+	return conv
+}
+
+// directIdleTimeout is how long a direct message conversation is kept in
+// memory after it was last used.
+const directIdleTimeout = 24 * time.Hour
+
+// conversation returns the conversation for a channel or nickname, using
+// the profile last selected for it.
+func (bot *Bot) conversation(target string) *Conversation {
+	key := strings.ToLower(target)
+	bot.conversationsMu.Lock()
+	defer bot.conversationsMu.Unlock()
+	if !isChannel(target) {
+		bot.lastUsed[key] = time.Now()
+	}
+	if conv, ok := bot.conversations[key]; ok {
+		return conv
+	}
+	bot.evictIdleConversations()
+
+	profile, saved := activeProfiles()[key]
+	if !saved {
+		profile = defaultProfile
+	}
+	if profile != "" {
+		if _, err := os.Stat(filepath.Join("profiles", profile)); err != nil {
+			slog.Warn("Saved profile no longer exists", "target", target, "profile", profile)
+			profile = ""
+		}
+	}
+	conv := bot.newConversation(target, profile)
+	bot.conversations[key] = conv
+	return conv
+}
+
+// evictIdleConversations drops direct message conversations that have not
+// been used for a while, as every nickname that messages the bot gets one.
+// Their profile is saved, so it is loaded again if the user comes back.
+// Conversations with a model chosen with "!model" are kept, as the choice
+// is only held in memory. It is called with conversationsMu held.
+func (bot *Bot) evictIdleConversations() {
+	for key, used := range bot.lastUsed {
+		if time.Since(used) < directIdleTimeout {
+			continue
+		}
+		if conv, ok := bot.conversations[key]; ok && conv.Model != conv.Settings.Model {
+			continue
+		}
+		delete(bot.conversations, key)
+		delete(bot.lastUsed, key)
+	}
+}
+
+// setConversation replaces a conversation, saving its profile so it is
+// used again after a restart.
+func (bot *Bot) setConversation(conv *Conversation) error {
+	key := strings.ToLower(conv.Target)
+	bot.conversationsMu.Lock()
+	bot.conversations[key] = conv
+	if conv.isDirect() {
+		bot.lastUsed[key] = time.Now()
+	}
+	bot.conversationsMu.Unlock()
+
+	activeProfilesMu.Lock()
+	defer activeProfilesMu.Unlock()
+	profiles := readActiveProfiles()
+	current, saved := profiles[key]
+	if conv.Profile == "" && defaultProfile == "" {
+		if !saved {
+			return nil
+		}
+		delete(profiles, key)
+	} else {
+		// An empty profile is saved when "--profile" is set, so choosing
+		// the default configuration is remembered.
+		if saved && current == conv.Profile {
+			return nil
+		}
+		profiles[key] = conv.Profile
+	}
+	content, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getStateFilePath("active_profiles.json"), content, 0644)
+}
+
+// profileInUse reports whether any conversation uses the profile, or it is
+// the one given with "--profile", which conversations without a saved
+// profile use.
+func (bot *Bot) profileInUse(profile string) bool {
+	if profile == defaultProfile {
+		return true
+	}
+	bot.conversationsMu.Lock()
+	defer bot.conversationsMu.Unlock()
+	for _, conv := range bot.conversations {
+		if conv.Profile == profile {
+			return true
+		}
+	}
+	for _, active := range activeProfiles() {
+		if active == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// activeProfilesMu guards "active_profiles.json", so it is not read while
+// setConversation is replacing it.
+var activeProfilesMu sync.Mutex
+
+// activeProfiles reads "active_profiles.json", which maps lowercase channel
+// names and nicknames to the profile selected for them.
+func activeProfiles() map[string]string {
+	activeProfilesMu.Lock()
+	defer activeProfilesMu.Unlock()
+	return readActiveProfiles()
+}
+
+// readActiveProfiles is activeProfiles for callers holding activeProfilesMu.
+func readActiveProfiles() map[string]string {
+	profiles := make(map[string]string)
+	content, err := os.ReadFile(getStateFilePath("active_profiles.json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Error reading active profiles", "error", err)
+		}
+		return profiles
+	}
+	if err := json.Unmarshal(content, &profiles); err != nil {
+		slog.Warn("Error decoding active profiles", "error", err)
+	}
+	return profiles
+}
+
+// getStateFilePath keeps files outside of profile directories, in the
+// data directory or the config directory if there is one, so they apply
+// whatever the profile.
+func getStateFilePath(fileName string) string {
+	if dataDir != "" {
+		return filepath.Join(dataDir, fileName)
+	}
+	if _, err := os.Stat(configDir); err == nil {
+		return filepath.Join(configDir, fileName)
+	}
+	return fileName
+}
@@ -22,8 +22,18 @@ elif [ -f "/app/config/model.gguf" ]; then
   MODEL_FILE="/app/config/model.gguf"
 fi
 
-# Run llamafile if a model file was found
-if [ -n "$MODEL_FILE" ]; then
+# Find config.json, which may be moved with NISABA_CONFIG
+CONFIG_FILE="${NISABA_CONFIG:-/app/config}"
+if [ -d "$CONFIG_FILE" ]; then
+  CONFIG_FILE="$CONFIG_FILE/config.json"
+fi
+
+# Run llamafile if a model file was found, unless Nisaba runs it itself
+if [ -n "$NISABA_BACKEND" ]; then
+  echo "Backend settings found in NISABA_BACKEND. Nisaba will run llamafile..."
+elif grep -q '"backend"' "$CONFIG_FILE" 2>/dev/null; then
+  echo "Backend settings found in config.json. Nisaba will run llamafile..."
+elif [ -n "$MODEL_FILE" ]; then
   echo "Running llamafile with model file $MODEL_FILE and arguments: $LLAMAFILE_ARGS"
   /app/llamafile -m $MODEL_FILE $LLAMAFILE_ARGS &
 else
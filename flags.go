@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// configDir holds config.json and the default configuration files.
+	configDir = "config"
+	// configFile is config.json given with "--config", if any.
+	configFile string
+	// dataDir is where files written at runtime are kept, if set with
+	// "--data-dir", instead of beside the configuration files.
+	dataDir string
+	// defaultProfile is used by channels and direct messages that have no
+	// profile selected with "!profile".
+	defaultProfile string
+)
+
+// Flags are the command-line options. Each can also be set with an
+// environment variable, which the flag overrides.
+type Flags struct {
+	Config   string
+	DataDir  string
+	Profile  string
+	LogLevel string
+	Validate bool
+}
+
+// parseFlags reads the command-line options, printing the usage if they
+// are not valid.
+func parseFlags(args []string) (Flags, error) {
+	var flags Flags
+	fs := flag.NewFlagSet("nisaba", flag.ContinueOnError)
+	fs.StringVar(&flags.Config, "config", os.Getenv("NISABA_CONFIG"), "path of config.json, or of the directory holding it (env NISABA_CONFIG)")
+	fs.StringVar(&flags.DataDir, "data-dir", os.Getenv("NISABA_DATA_DIR"), "directory for history, memories and other files written at runtime (env NISABA_DATA_DIR)")
+	fs.StringVar(&flags.Profile, "profile", os.Getenv("NISABA_PROFILE"), "profile used where none has been selected with !profile (env NISABA_PROFILE)")
+	fs.StringVar(&flags.LogLevel, "log-level", "", "log level, overriding log_level in config.json")
+	fs.BoolVar(&flags.Validate, "validate", false, "check the configuration and exit")
+	if err := fs.Parse(args); err != nil {
+		return flags, err
+	}
+	if fs.NArg() > 0 {
+		err := fmt.Errorf("unexpected argument '%s'", fs.Arg(0))
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return flags, err
+	}
+	return flags, nil
+}
+
+// applyFlags sets where the configuration and data are read and written.
+// The data directory is created if needed, except when validating, which
+// leaves everything as it is.
+func applyFlags(flags Flags) error {
+	if flags.Config != "" {
+		info, err := os.Stat(flags.Config)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			configDir = flags.Config
+		} else {
+			configDir, configFile = filepath.Dir(flags.Config), flags.Config
+		}
+	}
+	if flags.DataDir != "" {
+		if !flags.Validate {
+			if err := os.MkdirAll(flags.DataDir, 0755); err != nil {
+				return err
+			}
+		}
+		dataDir = flags.DataDir
+	}
+	if flags.Profile != "" && !strings.EqualFold(flags.Profile, "default") {
+		if err := validateProfileName(flags.Profile); err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join("profiles", flags.Profile)); err != nil {
+			return fmt.Errorf("profile '%s' does not exist", flags.Profile)
+		}
+		defaultProfile = flags.Profile
+	}
+	return nil
+}
+
+// applyEnvironment overrides fields of config with environment variables
+// named after their JSON names, e.g. NISABA_API_KEY for "api_key". Objects
+// and arrays are given in JSON, though a list of names may also be given
+// separated by commas.
+func applyEnvironment(config *Config) error {
+	val := reflect.ValueOf(config).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		envName := "NISABA_" + strings.ToUpper(name)
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setFieldFromString(val.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %w", envName, err)
+		}
+	}
+	return nil
+}
+
+func setFieldFromString(field reflect.Value, value string) error {
+	kind := field.Kind()
+	elemType := field.Type()
+	if kind == reflect.Pointer {
+		elemType = field.Type().Elem()
+	}
+
+	parsed := reflect.New(elemType).Elem()
+	switch elemType.Kind() {
+	case reflect.String:
+		parsed.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+		parsed.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be a whole number")
+		}
+		parsed.SetInt(int64(n))
+	case reflect.Slice:
+		if elemType.Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			parsed.Set(reflect.ValueOf(items))
+			break
+		}
+		fallthrough
+	default:
+		if err := json.Unmarshal([]byte(value), parsed.Addr().Interface()); err != nil {
+			return err
+		}
+	}
+
+	if kind == reflect.Pointer {
+		field.Set(parsed.Addr())
+	} else {
+		field.Set(parsed)
+	}
+	return nil
+}
+
+// validateConfig checks the files read when messages arrive, which would
+// otherwise only be reported then, for "--validate".
+func validateConfig(bot *Bot, conv *Conversation) error {
+	if _, err := loadOptions(conv, "options.json"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("options.json: %w", err)
+	}
+	if _, err := loadTriggers(conv); err != nil {
+		return fmt.Errorf("triggers.json: %w", err)
+	}
+	if _, err := loadSchedule(conv); err != nil {
+		return fmt.Errorf("schedule.json: %w", err)
+	}
+	if bot.Config.Backend != nil {
+		supervisor, err := NewSupervisor(bot.Config.Backend, *bot.Config.APIURL)
+		if err != nil {
+			return fmt.Errorf("backend: %w", err)
+		}
+		bot.backend = supervisor
+	}
+	if _, err := NewHealthMonitor(bot); err != nil {
+		return fmt.Errorf("health_check: %w", err)
+	}
+	return nil
+}
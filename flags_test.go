@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyEnvironment(t *testing.T) {
+	t.Setenv("NISABA_CHANNEL", "#env")
+	t.Setenv("NISABA_API_KEY", "secret")
+	t.Setenv("NISABA_USE_SSL", "false")
+	t.Setenv("NISABA_MESSAGE_SIZE", "300")
+	t.Setenv("NISABA_ADMINS", "$a:alice, *!*@trusted.host,")
+	t.Setenv("NISABA_ALIASES", `["nis", "bot"]`)
+	t.Setenv("NISABA_USER_RATE_LIMIT", `{"rate": 2, "burst": 4}`)
+	t.Setenv("NISABA_TOOLS", `{"#a": ["calculator"]}`)
+
+	nick := "nisaba"
+	config := Config{Channel: "#file", Nickname: &nick}
+	if err := applyEnvironment(&config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Channel != "#env" {
+		t.Errorf("Channel = %q", config.Channel)
+	}
+	if config.Nickname != &nick || nick != "nisaba" {
+		t.Errorf("Nickname changed without a variable")
+	}
+	if config.APIKey == nil || *config.APIKey != "secret" {
+		t.Errorf("APIKey = %v", config.APIKey)
+	}
+	if config.UseSSL == nil || *config.UseSSL {
+		t.Errorf("UseSSL = %v", config.UseSSL)
+	}
+	if config.MessageSize == nil || *config.MessageSize != 300 {
+		t.Errorf("MessageSize = %v", config.MessageSize)
+	}
+	if want := []string{"$a:alice", "*!*@trusted.host"}; !reflect.DeepEqual(config.Admins, want) {
+		t.Errorf("Admins = %q, want %q", config.Admins, want)
+	}
+	if want := []string{"nis", "bot"}; !reflect.DeepEqual(config.Aliases, want) {
+		t.Errorf("Aliases = %q, want %q", config.Aliases, want)
+	}
+	if want := (&RateLimit{Rate: 2, Burst: 4}); !reflect.DeepEqual(config.UserRateLimit, want) {
+		t.Errorf("UserRateLimit = %+v, want %+v", config.UserRateLimit, want)
+	}
+	if want := map[string][]string{"#a": {"calculator"}}; !reflect.DeepEqual(config.Tools, want) {
+		t.Errorf("Tools = %v, want %v", config.Tools, want)
+	}
+}
+
+func TestApplyEnvironmentErrors(t *testing.T) {
+	tests := []struct {
+		name, value string
+	}{
+		{"NISABA_USE_SSL", "maybe"},
+		{"NISABA_DELAY", "1.5"},
+		{"NISABA_PASTE", "{"},
+		{"NISABA_ALIASES", "[1, 2]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			if err := applyEnvironment(&Config{}); err == nil {
+				t.Errorf("%s=%q was accepted", tt.name, tt.value)
+			}
+		})
+	}
+}
+
+func TestSetFieldFromString(t *testing.T) {
+	var s struct {
+		Text  string
+		Flag  *bool
+		Count *int
+		List  []string
+		Limit *RateLimit
+	}
+	val := reflect.ValueOf(&s).Elem()
+	tests := []struct {
+		field, value string
+		wantErr      bool
+	}{
+		{"Text", "hello", false},
+		{"Flag", "TRUE", false},
+		{"Flag", "yes", true},
+		{"Count", "-3", false},
+		{"Count", "three", true},
+		{"List", " a ,, b ", false},
+		{"Limit", `{"rate": 0.5}`, false},
+		{"Limit", "0.5", true},
+	}
+	for _, tt := range tests {
+		err := setFieldFromString(val.FieldByName(tt.field), tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("setFieldFromString(%s, %q) error = %v, want error %v", tt.field, tt.value, err, tt.wantErr)
+		}
+	}
+	if s.Text != "hello" || s.Flag == nil || !*s.Flag || s.Count == nil || *s.Count != -3 {
+		t.Errorf("fields = %q, %v, %v", s.Text, s.Flag, s.Count)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(s.List, want) {
+		t.Errorf("List = %q, want %q", s.List, want)
+	}
+	if s.Limit == nil || s.Limit.Rate != 0.5 {
+		t.Errorf("Limit = %+v", s.Limit)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/sourcebunny/nisaba
 
-go 1.19
+go 1.21
 
 require github.com/thoj/go-ircevent v0.0.0-20210723090443-73e444401d64
 
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig sets how often the API endpoint is checked, and what
+// Nisaba does while it is down.
+type HealthCheckConfig struct {
+	Interval    int      `json:"interval"`
+	URLs        []string `json:"urls"`
+	AwayMessage string   `json:"away_message"`
+	DownMessage string   `json:"down_message"`
+	UpMessage   string   `json:"up_message"`
+}
+
+// HealthMonitor keeps the state of the API endpoint from the last check.
+type HealthMonitor struct {
+	urls   []string
+	apiKey string
+
+	mu      sync.Mutex
+	checked bool
+	up      bool
+	since   time.Time
+	lastErr error
+}
+
+// healthURLs returns the URLs checked for the endpoint in api_url: the
+// llama.cpp "/health" endpoint and the OpenAI compatible "/v1/models". The
+// endpoint is up if either answers.
+func healthURLs(bot *Bot) ([]string, error) {
+	if bot.Config.HealthCheck != nil && len(bot.Config.HealthCheck.URLs) > 0 {
+		return bot.Config.HealthCheck.URLs, nil
+	}
+	if bot.backend != nil {
+		return []string{bot.backend.healthURL}, nil
+	}
+	apiURL, err := url.Parse(*bot.Config.APIURL)
+	if err != nil {
+		return nil, err
+	}
+	base := apiURL.Scheme + "://" + apiURL.Host
+	return []string{base + "/health", base + "/v1/models"}, nil
+}
+
+func NewHealthMonitor(bot *Bot) (*HealthMonitor, error) {
+	urls, err := healthURLs(bot)
+	if err != nil {
+		return nil, err
+	}
+	return &HealthMonitor{urls: urls, apiKey: *bot.Config.APIKey}, nil
+}
+
+// Check probes the endpoint and records the result, reporting whether the
+// state changed since the last check.
+func (h *HealthMonitor) Check(ctx context.Context) (up, changed bool) {
+	var err error
+	for _, healthURL := range h.urls {
+		if err = checkHealth(ctx, healthURL, h.apiKey); err == nil {
+			break
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	up = err == nil
+	changed = !h.checked || up != h.up
+	if changed {
+		h.since = time.Now()
+	}
+	h.checked, h.up, h.lastErr = true, up, err
+	return up, changed
+}
+
+// State describes the endpoint in a few words, e.g. "up for 2h5m".
+func (h *HealthMonitor) State() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.checked {
+		return "not checked yet"
+	}
+	duration := formatDuration(time.Since(h.since))
+	if h.up {
+		return "up for " + duration
+	}
+	return fmt.Sprintf("down for %s (%s)", duration, h.lastErr)
+}
+
+// runHealthChecks checks the endpoint every "interval" seconds, setting
+// the bot away and telling the channel when it goes down or comes back.
+func (ircBot *IRCBot) runHealthChecks() {
+	config := ircBot.Config.HealthCheck
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		up, changed := ircBot.health.Check(context.Background())
+		// Nothing needs announcing if the endpoint is up from the start.
+		if changed && !(first && up) {
+			ircBot.backendStateChanged(up)
+		}
+		<-ticker.C
+	}
+}
+
+func (ircBot *IRCBot) backendStateChanged(up bool) {
+	config := ircBot.Config.HealthCheck
+	if up {
+		slog.Info("API endpoint is up")
+		if config.AwayMessage != "" {
+			ircBot.IRCConnection.SendRaw("AWAY")
+		}
+		if config.UpMessage != "" {
+			ircBot.IRCConnection.Notice(ircBot.Config.Channel, config.UpMessage)
+		}
+		return
+	}
+	slog.Warn("API endpoint is down", "state", ircBot.health.State())
+	if config.AwayMessage != "" {
+		ircBot.IRCConnection.SendRaw("AWAY :" + config.AwayMessage)
+	}
+	if config.DownMessage != "" {
+		ircBot.IRCConnection.Notice(ircBot.Config.Channel, config.DownMessage)
+	}
+}
+
+// formatDuration rounds d to the largest units, e.g. "3d4h" or "5m10s".
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		days := d / (24 * time.Hour)
+		return fmt.Sprintf("%dd%dh", days, (d-days*24*time.Hour)/time.Hour)
+	case d >= time.Hour:
+		return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+	default:
+		return d.Round(time.Second).String()
+	}
+}
+
+// statusCheckTimeout limits how long "!status" probes the endpoint when
+// there are no periodic checks.
+const statusCheckTimeout = 5 * time.Second
+
+// statusCommand reports the state of the API endpoint and the conversation.
+// It may probe the endpoint, so it runs outside the IRC loop.
+func statusCommand(ctx context.Context, bot *Bot, conv *Conversation, user string) {
+	var backend string
+	switch {
+	case bot.backend != nil && !bot.backend.Ready():
+		backend = "starting"
+	case bot.health != nil:
+		if bot.Config.HealthCheck == nil {
+			// Without periodic checks, check now.
+			ctx, cancel := context.WithTimeout(ctx, statusCheckTimeout)
+			bot.health.Check(ctx)
+			cancel()
+		}
+		backend = bot.health.State()
+	default:
+		backend = "unknown"
+	}
+	model := conv.Model
+	if model == "" {
+		model = "endpoint default"
+	}
+	sendMessage(conv.Target, fmt.Sprintf("%s: Backend: %s | Model: %s | Profile: %s | Queue: %d | Uptime: %s | History: %d messages",
+		user, backend, model, conv.profileLabel(), int(metrics.QueueDepth.Total()), formatDuration(time.Since(bot.Started)), len(loadMessageHistory(conv))))
+}
@@ -1,22 +1,66 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/thoj/go-ircevent"
-	"log"
+	"log/slog"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 type IRCBot struct {
 	*Bot
 	IRCConnection *irc.Connection
+
+	userLimiter    *rateLimiter
+	channelLimiter *rateLimiter
+	outputLimiter  *rateLimiter
+	throttledMu    sync.Mutex
+	throttled      map[string]time.Time
+
+	outbound      chan outboundMessage
+	paster        Paster
+	schedulerOnce sync.Once
+	healthOnce    sync.Once
+
+	addressRegexp *regexp.Regexp
+	mentionRegexp *regexp.Regexp
+	repliedMu     sync.Mutex
+	replied       map[string]time.Time
+
+	prefixMu sync.Mutex
+	selfUser string
+	selfHost string
+
+	// joined holds the lowercase names of the channels the bot is in.
+	joinedMu sync.Mutex
+	joined   map[string]bool
 }
 
 func NewIRCBot(bot *Bot) *IRCBot {
-	ircBot := &IRCBot{Bot: bot}
+	ircBot := &IRCBot{
+		Bot:            bot,
+		userLimiter:    newRateLimiter(bot.Config.UserRateLimit),
+		channelLimiter: newRateLimiter(bot.Config.ChannelRateLimit),
+		outputLimiter:  newRateLimiter(bot.Config.OutputRateLimit),
+		throttled:      make(map[string]time.Time),
+		replied:        make(map[string]time.Time),
+		joined:         make(map[string]bool),
+		outbound:       make(chan outboundMessage, outboundQueueSize),
+	}
+	ircBot.compileAddressRegexps()
+	if bot.Config.Paste != nil {
+		paster, err := NewPaster(bot.Config.Paste)
+		if err != nil {
+			slog.Error("Paste service disabled", "error", err)
+		} else {
+			ircBot.paster = paster
+		}
+	}
 	nickname := "Nisaba"
 	if bot.Config.Nickname != nil {
 		nickname = *bot.Config.Nickname
@@ -25,6 +69,7 @@ func NewIRCBot(bot *Bot) *IRCBot {
 	irccon := irc.IRC(nickname, nickname)
 	irccon.VerboseCallbackHandler = bot.Config.Debug != nil && *bot.Config.Debug
 	irccon.Debug = bot.Config.Debug != nil && *bot.Config.Debug
+	irccon.Log = slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug)
 
 	useSSL := bot.Config.UseSSL != nil && *bot.Config.UseSSL
 	irccon.UseTLS = useSSL
@@ -36,64 +81,383 @@ func NewIRCBot(bot *Bot) *IRCBot {
 		}
 	}
 
-	irccon.AddCallback("001", func(e *irc.Event) { irccon.Join(bot.Config.Channel) })
+	irccon.AddCallback("001", func(e *irc.Event) {
+		// Ask for the services account of each sender, for "$a:" masks.
+		irccon.SendRaw("CAP REQ :account-tag")
+		ircBot.clearJoined()
+		irccon.Join(bot.Config.Channel)
+		ircBot.schedulerOnce.Do(func() { go ircBot.runScheduler() })
+		if bot.Config.HealthCheck != nil {
+			ircBot.healthOnce.Do(func() { go ircBot.runHealthChecks() })
+		}
+	})
 	irccon.AddCallback("PRIVMSG", ircBot.handleMessage)
+	irccon.AddCallback("JOIN", func(e *irc.Event) {
+		if e.Nick == irccon.GetNick() {
+			ircBot.setPrefix(e.User, e.Host)
+			if len(e.Arguments) > 0 {
+				ircBot.setJoined(e.Arguments[0], true)
+			}
+		}
+		ircBot.handleTriggerEvent("join", e)
+	})
+	irccon.AddCallback("PART", func(e *irc.Event) {
+		if e.Nick == irccon.GetNick() && len(e.Arguments) > 0 {
+			ircBot.setJoined(e.Arguments[0], false)
+		}
+		ircBot.handleTriggerEvent("part", e)
+	})
+	irccon.AddCallback("TOPIC", func(e *irc.Event) { ircBot.handleTriggerEvent("topic", e) })
+	irccon.AddCallback("KICK", func(e *irc.Event) {
+		if len(e.Arguments) > 1 && e.Arguments[1] == irccon.GetNick() {
+			ircBot.setJoined(e.Arguments[0], false)
+		}
+		ircBot.handleTriggerEvent("kick", e)
+	})
+	// RPL_HOSTHIDDEN reports a cloaked host that replaces the real one.
+	irccon.AddCallback("396", func(e *irc.Event) {
+		if len(e.Arguments) > 1 {
+			ircBot.setPrefix("", e.Arguments[1])
+		}
+	})
 
 	ircBot.IRCConnection = irccon
+	go ircBot.runOutbound()
 	return ircBot
 }
 
+func (ircBot *IRCBot) setJoined(channel string, joined bool) {
+	ircBot.joinedMu.Lock()
+	defer ircBot.joinedMu.Unlock()
+	if joined {
+		ircBot.joined[strings.ToLower(channel)] = true
+	} else {
+		delete(ircBot.joined, strings.ToLower(channel))
+	}
+}
+
+// clearJoined forgets the channels joined before reconnecting.
+func (ircBot *IRCBot) clearJoined() {
+	ircBot.joinedMu.Lock()
+	defer ircBot.joinedMu.Unlock()
+	ircBot.joined = make(map[string]bool)
+}
+
+// inChannel reports whether the bot is in channel.
+func (ircBot *IRCBot) inChannel(channel string) bool {
+	ircBot.joinedMu.Lock()
+	defer ircBot.joinedMu.Unlock()
+	return ircBot.joined[strings.ToLower(channel)]
+}
+
 func (ircBot *IRCBot) handleMessage(e *irc.Event) {
-	if !ircBot.IsAvailable || blockedUsers[e.Nick] {
+	target := e.Arguments[0]
+	if !isChannel(target) {
+		// Direct messages are answered to the sender.
+		target = e.Nick
+	}
+	conv := ircBot.conversation(target)
+	sender := senderFromEvent(e)
+	if ircBot.isBlocked(conv, sender) {
 		return
 	}
 
-	message := e.Message()
-	re := regexp.MustCompile(`(?i)^` + regexp.QuoteMeta(*ircBot.Config.Nickname) + `[:,]?\s?(.*)`)
-	matches := re.FindStringSubmatch(strings.TrimSpace(message))
-	if len(matches) > 1 {
-		user := e.Nick
-		entireMessage := matches[1]
+	entireMessage, addressed := ircBot.addressedMessage(e)
+	if conv.isDirect() && !addressed {
+		entireMessage, addressed = strings.TrimSpace(e.Message()), true
+	}
+	if addressed {
+		ctx := withSender(withRequestID(context.Background()), sender)
+		logger := loggerFrom(ctx)
+		metrics.MessagesReceived.Inc(conv.metricLabels()...)
+		if !ircBot.allowMessage(e, conv) {
+			metrics.MessagesThrottled.Inc(conv.metricLabels()...)
+			logger.Info("Throttled message", "nick", e.Nick, "host", e.Host, "channel", conv.Target)
+			ircBot.notifyThrottled(conv, e.Nick, e.Host)
+			return
+		}
+		command := ""
 		if strings.HasPrefix(entireMessage, "!") {
-			handleCommands(ircBot.Bot, strings.Fields(entireMessage)[0], strings.Join(strings.Fields(entireMessage)[1:], " "), user)
+			command = strings.Fields(entireMessage)[0]
+		}
+		if !ircBot.IsAvailable && !readOnlyCommands[command] {
+			metrics.MessagesDropped.Inc(conv.metricLabels()...)
+			logger.Info("Dropped message while busy", "nick", e.Nick, "channel", conv.Target)
+			return
+		}
+		user := e.Nick
+		logger.Info("Received message", "nick", user, "channel", conv.Target, "profile", conv.profileLabel(), "message", entireMessage)
+		if command != "" {
+			handleCommands(ctx, ircBot.Bot, conv, command, strings.Join(strings.Fields(entireMessage)[1:], " "), user, ircBot.isAdmin(sender))
 		} else {
-			ircBot.processMessage(user, entireMessage)
+			ircBot.processMessage(ctx, conv, user, entireMessage)
+		}
+	} else {
+		ircBot.handleTriggerEvent("message", e)
+	}
+}
+
+// otherNickRegexp matches a message addressed to someone else, such as
+// "alice: thanks", which should not be answered within the reply window.
+var otherNickRegexp = regexp.MustCompile(`^[^\s:]+:\s`)
+
+// compileAddressRegexps prepares the patterns matching the bot's nickname
+// and aliases, once rather than for every message.
+func (ircBot *IRCBot) compileAddressRegexps() {
+	names := []string{regexp.QuoteMeta(*ircBot.Config.Nickname)}
+	for _, alias := range ircBot.Config.Aliases {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			names = append(names, regexp.QuoteMeta(alias))
+		}
+	}
+	pattern := `(?:` + strings.Join(names, "|") + `)`
+	ircBot.addressRegexp = regexp.MustCompile(`(?i)^` + pattern + `(?:[:,]\s*|\s+|$)(.*)`)
+	if *ircBot.Config.AddressAnywhere {
+		ircBot.mentionRegexp = regexp.MustCompile(`(?i)\b` + pattern + `\b`)
+	}
+}
+
+// addressedMessage reports whether a message is meant for the bot, and
+// returns the message without the name or prefix used to address it. A
+// message can start with the nickname or an alias, start with the command
+// prefix, mention the bot anywhere if "address_anywhere" is set, or come
+// from a user the bot answered within the last "reply_window" seconds.
+func (ircBot *IRCBot) addressedMessage(e *irc.Event) (string, bool) {
+	message := strings.TrimSpace(e.Message())
+	if matches := ircBot.addressRegexp.FindStringSubmatch(message); matches != nil {
+		return matches[1], true
+	}
+	if prefix := *ircBot.Config.CommandPrefix; prefix != "" {
+		fields := strings.Fields(message)
+		if len(fields) > 0 && strings.EqualFold(fields[0], prefix) {
+			return strings.TrimSpace(message[len(fields[0]):]), true
 		}
 	}
+	if ircBot.mentionRegexp != nil && ircBot.mentionRegexp.MatchString(message) {
+		return message, true
+	}
+	if ircBot.inReplyWindow(e.Nick) && !otherNickRegexp.MatchString(message) {
+		return message, true
+	}
+	return "", false
+}
+
+func (ircBot *IRCBot) markReplied(user string) {
+	if *ircBot.Config.ReplyWindow == 0 {
+		return
+	}
+	ircBot.repliedMu.Lock()
+	defer ircBot.repliedMu.Unlock()
+	ircBot.replied[strings.ToLower(user)] = time.Now()
+}
+
+func (ircBot *IRCBot) inReplyWindow(user string) bool {
+	if *ircBot.Config.ReplyWindow == 0 {
+		return false
+	}
+	ircBot.repliedMu.Lock()
+	defer ircBot.repliedMu.Unlock()
+	last, ok := ircBot.replied[strings.ToLower(user)]
+	if !ok {
+		return false
+	}
+	if time.Since(last) > time.Duration(*ircBot.Config.ReplyWindow)*time.Second {
+		delete(ircBot.replied, strings.ToLower(user))
+		return false
+	}
+	return true
+}
+
+// allowMessage checks the per user and per channel rate limits. Users are
+// tracked by hostmask so that changing nick does not reset their limit.
+func (ircBot *IRCBot) allowMessage(e *irc.Event, conv *Conversation) bool {
+	userKey := e.Nick
+	if e.Host != "" {
+		userKey = "*!*@" + e.Host
+	}
+	return allowBoth(ircBot.userLimiter, userKey, ircBot.channelLimiter, strings.ToLower(conv.Target))
+}
+
+// notifyThrottled tells a user they are being throttled, at most once a
+// minute so the replies themselves cannot flood the channel.
+func (ircBot *IRCBot) notifyThrottled(conv *Conversation, user, host string) {
+	if *ircBot.Config.ThrottleMessage == "" {
+		return
+	}
+	ircBot.throttledMu.Lock()
+	last, ok := ircBot.throttled[host]
+	now := time.Now()
+	if ok && now.Sub(last) < time.Minute {
+		ircBot.throttledMu.Unlock()
+		return
+	}
+	ircBot.throttled[host] = now
+	ircBot.throttledMu.Unlock()
+
+	ircBot.sendIRCMessage(conv.Target, fmt.Sprintf("%s: %s", user, *ircBot.Config.ThrottleMessage))
 }
 
+// outboundMessage is a line waiting to be sent, after delay.
+type outboundMessage struct {
+	channel string
+	message string
+	delay   time.Duration
+}
+
+// outboundQueueSize is how many lines can wait to be sent. Lines beyond it
+// are dropped rather than holding up the caller, which may be the IRC
+// connection's own loop.
+const outboundQueueSize = 512
+
+// sendIRCMessage queues a line to be sent to channel.
 func (ircBot *IRCBot) sendIRCMessage(channel, message string) {
-	ircBot.IRCConnection.Privmsg(channel, message)
+	ircBot.queueMessage(outboundMessage{channel: channel, message: message})
+}
+
+func (ircBot *IRCBot) queueMessage(msg outboundMessage) {
+	select {
+	case ircBot.outbound <- msg:
+	default:
+		slog.Warn("Outgoing message queue is full, dropping message", "channel", msg.channel)
+	}
 }
 
-func (ircBot *IRCBot) processMessage(user, message string) {
+// runOutbound sends queued lines in order, waiting for the output rate
+// limit and the delay between the lines of a response.
+func (ircBot *IRCBot) runOutbound() {
+	for msg := range ircBot.outbound {
+		time.Sleep(msg.delay)
+		ircBot.outputLimiter.Wait("output")
+		ircBot.IRCConnection.Privmsg(msg.channel, msg.message)
+	}
+}
+
+func (ircBot *IRCBot) processMessage(ctx context.Context, conv *Conversation, user, message string) {
 	if len(message) == 0 {
 		return
 	}
-	ircBot.sendIRCMessage(ircBot.Config.Channel, fmt.Sprintf("%s: I will think about that and be back with you shortly.", user))
+	if ircBot.backend != nil && !ircBot.backend.Ready() {
+		ircBot.sendMessage(conv, user, "The model is still loading, please try again in a moment.")
+		return
+	}
+	ircBot.sendMessage(conv, user, "I will think about that and be back with you shortly.")
+	metrics.QueueDepth.Add(1, conv.metricLabels()...)
 	go func() {
-		response := ircBot.callAPI(message)
-		ircBot.sendMessage(user, response)
+		defer metrics.QueueDepth.Add(-1, conv.metricLabels()...)
+		ctx, message, stop := ircBot.guardedInput(ctx, conv, user, message)
+		if stop {
+			ircBot.sendMessage(conv, user, message)
+			return
+		}
+		if message == "" {
+			return
+		}
+		response := ircBot.callAPI(ctx, conv, user, message)
+		ircBot.sendMessage(conv, user, response)
+		ircBot.markReplied(user)
+		metrics.MessagesAnswered.Inc(conv.metricLabels()...)
+		loggerFrom(ctx).Info("Sent response", "nick", user, "channel", conv.Target, "response", response)
+		if *ircBot.Config.MemoryExtraction {
+			ircBot.extractMemories(ctx, conv, user, message)
+		}
 	}()
 }
 
-func (ircBot *IRCBot) sendMessage(user, response string) {
-	messages := splitMessage(response, *ircBot.Config.MessageSize)
+func (ircBot *IRCBot) setPrefix(user, host string) {
+	ircBot.prefixMu.Lock()
+	defer ircBot.prefixMu.Unlock()
+	if user != "" {
+		ircBot.selfUser = user
+	}
+	ircBot.selfHost = host
+}
+
+// lineBudget returns the number of bytes available for the text of a
+// PRIVMSG to target, after the server adds our "nick!user@host" prefix.
+// Until the bot has seen its own hostmask the longest valid one is assumed.
+func (ircBot *IRCBot) lineBudget(target string) int {
+	ircBot.prefixMu.Lock()
+	user, host := ircBot.selfUser, ircBot.selfHost
+	ircBot.prefixMu.Unlock()
+	if user == "" {
+		user = strings.Repeat("x", 10)
+	}
+	if host == "" {
+		host = strings.Repeat("x", 63)
+	}
+	prefix := fmt.Sprintf(":%s!%s@%s PRIVMSG %s :", ircBot.IRCConnection.GetNick(), user, host, target)
+	return ircMaxLine - len("\r\n") - len(prefix)
+}
+
+// sendMessage sends a response in a conversation. In a channel the response
+// is addressed to user, in direct messages it is not.
+func (ircBot *IRCBot) sendMessage(conv *Conversation, user, response string) {
+	if conv.isDirect() {
+		user = ""
+	}
+	ircBot.sendReply(conv.Target, user, response)
+}
+
+// sendReply sends a response to channel, split into lines. The first line
+// is addressed to user, unless user is empty.
+func (ircBot *IRCBot) sendReply(channel, user, response string) {
+	maxSize := ircBot.lineBudget(channel)
+	if user != "" {
+		// The first line is addressed to the user, so reserve room for "user: ".
+		maxSize -= len(user) + 2
+	}
+	if *ircBot.Config.MessageSize < maxSize {
+		maxSize = *ircBot.Config.MessageSize
+	}
+	formatting := *ircBot.Config.Formatting
+	if conv := ircBot.conversation(channel); conv.Settings.Formatting != "" {
+		formatting = conv.Settings.Formatting
+	}
+	formatted := renderMarkdown(response, formatting, *ircBot.Config.DropTables)
+	messages := splitMessage(formatted, maxSize, *ircBot.Config.PreserveParagraphs, *ircBot.Config.ContinuationMarker)
+	if ircBot.paster != nil && shouldPaste(ircBot.Config.Paste, response, messages) {
+		messages = ircBot.pasteMessage(user, response, messages)
+	}
 	delay := time.Duration(*ircBot.Config.Delay) * time.Second
 	for i, msg := range messages {
+		line := outboundMessage{channel: channel, message: msg, delay: delay}
 		if i == 0 {
-			ircBot.sendIRCMessage(ircBot.Config.Channel, fmt.Sprintf("%s: %s", user, msg))
-		} else {
-			time.Sleep(delay)
-			ircBot.sendIRCMessage(ircBot.Config.Channel, msg)
+			line.delay = 0
+			if user != "" {
+				line.message = fmt.Sprintf("%s: %s", user, msg)
+			}
+		}
+		ircBot.queueMessage(line)
+	}
+}
+
+// pasteMessage uploads a long response and returns the lines to send in its
+// place: the first few lines of the response followed by a link to it. If the
+// upload fails the response is sent in full.
+func (ircBot *IRCBot) pasteMessage(user, response string, messages []string) []string {
+	link, err := ircBot.paster.Paste(response)
+	if err != nil {
+		slog.Error("Error uploading response to paste service", "error", err)
+		return messages
+	}
+	slog.Info("Uploaded response to paste service", "nick", user, "url", link)
+
+	var preview []string
+	for _, line := range messages {
+		if len(preview) >= ircBot.Config.Paste.PreviewLines {
+			break
+		}
+		if line != paragraphBreak {
+			preview = append(preview, line)
 		}
 	}
+	return append(preview, fmt.Sprintf("Full response: %s", link))
 }
 
 func (ircBot *IRCBot) ConnectAndListen() {
 	serverAndPort := fmt.Sprintf("%s:%s", ircBot.Config.Server, *ircBot.Config.Port)
 	if err := ircBot.IRCConnection.Connect(serverAndPort); err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+		fatal("Failed to connect", "server", serverAndPort, "error", err)
 	}
 
 	ircBot.IRCConnection.Loop()
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// Attributes that always carry secrets, and attributes that carry message
+// content which is only redacted when "log_redact_content" is enabled. Any
+// attribute holding text written by users or the model must use one of the
+// content keys, including remembered facts, tool arguments, option values
+// such as prompts, and the output of the backend.
+var (
+	secretLogKeys  = map[string]bool{"api_key": true, "authorization": true}
+	contentLogKeys = map[string]bool{
+		"content": true, "message": true, "payload": true, "response": true, "prompt": true, "query": true,
+		"fact": true, "arguments": true, "value": true, "reason": true, "line": true,
+	}
+)
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	injectionKey
+	senderKey
+	sourcesKey
+)
+
+// rotatingWriter appends to a log file and rotates it once it grows beyond
+// maxSize bytes, keeping up to maxBackups old files named "<path>.1" and up.
+type rotatingWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingWriter(path string, maxSize int64, maxBackups int) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	for i := w.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if w.maxBackups > 0 {
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+// setupLogging installs the default slog logger described by the config and
+// routes the standard library logger through it.
+func setupLogging(config Config) error {
+	level, err := parseLogLevel(*config.LogLevel)
+	if err != nil {
+		return err
+	}
+	if *config.Debug && level > slog.LevelDebug {
+		level = slog.LevelDebug
+	}
+
+	var out io.Writer = os.Stderr
+	if *config.LogFile != "" {
+		writer, err := newRotatingWriter(*config.LogFile, int64(*config.LogMaxSize)*1024*1024, *config.LogBackups)
+		if err != nil {
+			return err
+		}
+		out = writer
+	}
+
+	apiKey := *config.APIKey
+	redactContent := *config.LogRedact
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			key := strings.ToLower(a.Key)
+			if secretLogKeys[key] || (redactContent && contentLogKeys[key]) {
+				return slog.String(a.Key, redacted)
+			}
+			if a.Value.Kind() == slog.KindString && apiKey != "" && apiKey != "null" {
+				if value := a.Value.String(); strings.Contains(value, apiKey) {
+					return slog.String(a.Key, strings.ReplaceAll(value, apiKey, redacted))
+				}
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler
+	switch *config.LogFormat {
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	default:
+		return fmt.Errorf("unknown log format '%s'", *config.LogFormat)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	runExitFuncs()
+	os.Exit(1)
+}
+
+var (
+	exitMu    sync.Mutex
+	exitFuncs []func()
+)
+
+// atExit registers a function to run before Nisaba exits, such as stopping
+// the backend, so nothing is left running whichever way it exits.
+func atExit(f func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	exitFuncs = append(exitFuncs, f)
+}
+
+func runExitFuncs() {
+	exitMu.Lock()
+	funcs := exitFuncs
+	exitFuncs = nil
+	exitMu.Unlock()
+	for _, f := range funcs {
+		f()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// withRequestID returns a context whose logger tags every record with a new
+// request ID, so a message can be followed from IRC to the API and back.
+func withRequestID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, loggerKey, loggerFrom(ctx).With("request_id", newRequestID()))
+}
+
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
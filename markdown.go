@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// IRC formatting control codes.
+const (
+	ircBold          = "\x02"
+	ircItalic        = "\x1d"
+	ircUnderline     = "\x1f"
+	ircStrikethrough = "\x1e"
+	ircMonospace     = "\x11"
+	ircColor         = "\x03"
+)
+
+// ircLinkColor is the mIRC color used for link URLs (light blue).
+const ircLinkColor = "12"
+
+var (
+	fenceRegexp     = regexp.MustCompile("^\\s*(```|~~~)")
+	headerRegexp    = regexp.MustCompile(`^\s{0,3}(#{1,6})\s+(.*?)\s*#*\s*$`)
+	ruleRegexp      = regexp.MustCompile(`^\s{0,3}([-*_])(\s*[-*_]){2,}\s*$`)
+	quoteRegexp     = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	bulletRegexp    = regexp.MustCompile(`^(\s*)[-*+]\s+(?:\[([ xX])\]\s+)?(.*)$`)
+	numberedRegexp  = regexp.MustCompile(`^(\s*)(\d+)[.)]\s+(.*)$`)
+	tableRowRegexp  = regexp.MustCompile(`^\s*\|.*\|\s*$`)
+	tableSepRegexp  = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+	codeSpanRegexp  = regexp.MustCompile("`+([^`]+)`+")
+	imageRegexp     = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)[^)]*\)`)
+	linkRegexp      = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)[^)]*\)`)
+	boldRegexp      = regexp.MustCompile(`\*\*(\S(?:.*?\S)??)\*\*|\b__(\S(?:.*?\S)??)__\b`)
+	italicRegexp    = regexp.MustCompile(`\*(\S(?:.*?\S)??)\*|\b_(\S(?:.*?\S)??)_\b`)
+	strikeRegexp    = regexp.MustCompile(`~~(\S(?:.*?\S)??)~~`)
+	placeholderExpr = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// renderMarkdown converts a Markdown response for IRC. In "irc" mode the
+// Markdown is replaced by IRC formatting codes, in "strip" mode only the
+// Markdown syntax is removed, for channels that block formatting with +c.
+// Tables are aligned as plain text, or removed when dropTables is set.
+func renderMarkdown(text, mode string, dropTables bool) string {
+	if mode != "irc" && mode != "strip" {
+		return text
+	}
+	r := markdownRenderer{format: mode == "irc", dropTables: dropTables}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if match := fenceRegexp.FindStringSubmatch(line); match != nil {
+			fence := match[1]
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				out = append(out, r.codeLine(lines[i]))
+			}
+			continue
+		}
+
+		if tableRowRegexp.MatchString(line) {
+			var rows []string
+			for ; i < len(lines) && tableRowRegexp.MatchString(lines[i]); i++ {
+				rows = append(rows, lines[i])
+			}
+			i--
+			out = append(out, r.table(rows)...)
+			continue
+		}
+
+		out = append(out, r.line(line))
+	}
+	return strings.Join(out, "\n")
+}
+
+type markdownRenderer struct {
+	format     bool
+	dropTables bool
+}
+
+func (r markdownRenderer) wrap(code, text string) string {
+	if !r.format || text == "" {
+		return text
+	}
+	return code + text + code
+}
+
+// codeLine keeps the indentation of a line in a code block. Blank lines are
+// kept, rather than mistaken for paragraph breaks.
+func (r markdownRenderer) codeLine(line string) string {
+	line = strings.ReplaceAll(strings.TrimRight(line, " \t"), "\t", "    ")
+	if line == "" {
+		return keptBlankLine
+	}
+	return r.wrap(ircMonospace, line)
+}
+
+func (r markdownRenderer) line(line string) string {
+	if match := headerRegexp.FindStringSubmatch(line); match != nil {
+		text := r.inline(match[2])
+		if len(match[1]) == 1 {
+			return r.wrap(ircUnderline, r.wrap(ircBold, text))
+		}
+		return r.wrap(ircBold, text)
+	}
+	if ruleRegexp.MatchString(line) {
+		return ""
+	}
+	if match := quoteRegexp.FindStringSubmatch(line); match != nil {
+		return "> " + r.wrap(ircItalic, r.inline(match[1]))
+	}
+	if match := bulletRegexp.FindStringSubmatch(line); match != nil {
+		bullet := "•"
+		switch match[2] {
+		case " ":
+			bullet = "[ ]"
+		case "x", "X":
+			bullet = "[x]"
+		}
+		return listIndent(match[1]) + bullet + " " + r.inline(match[3])
+	}
+	if match := numberedRegexp.FindStringSubmatch(line); match != nil {
+		return listIndent(match[1]) + match[2] + ". " + r.inline(match[3])
+	}
+	return r.inline(line)
+}
+
+// listIndent normalizes nested list indentation to two spaces per level.
+func listIndent(indent string) string {
+	width := len(strings.ReplaceAll(indent, "\t", "    "))
+	return strings.Repeat("  ", width/2)
+}
+
+func (r markdownRenderer) inline(text string) string {
+	// Code spans are set aside first so their contents are left as-is.
+	var spans []string
+	text = codeSpanRegexp.ReplaceAllStringFunc(text, func(s string) string {
+		spans = append(spans, r.wrap(ircMonospace, codeSpanRegexp.FindStringSubmatch(s)[1]))
+		return fmt.Sprintf("\x00%d\x00", len(spans)-1)
+	})
+
+	text = imageRegexp.ReplaceAllStringFunc(text, func(s string) string {
+		match := imageRegexp.FindStringSubmatch(s)
+		return r.link(match[1], match[2])
+	})
+	text = linkRegexp.ReplaceAllStringFunc(text, func(s string) string {
+		match := linkRegexp.FindStringSubmatch(s)
+		return r.link(match[1], match[2])
+	})
+	text = r.replaceEmphasis(text, boldRegexp, ircBold)
+	text = r.replaceEmphasis(text, italicRegexp, ircItalic)
+	text = r.replaceEmphasis(text, strikeRegexp, ircStrikethrough)
+
+	return placeholderExpr.ReplaceAllStringFunc(text, func(s string) string {
+		var i int
+		fmt.Sscanf(placeholderExpr.FindStringSubmatch(s)[1], "%d", &i)
+		return spans[i]
+	})
+}
+
+// replaceEmphasis formats the text matched by re. As in CommonMark, the
+// markers must not be inside a word, so "2*3*4" is left as it is.
+func (r markdownRenderer) replaceEmphasis(text string, re *regexp.Regexp, code string) string {
+	var sb strings.Builder
+	for {
+		loc := re.FindStringSubmatchIndex(text)
+		if loc == nil {
+			break
+		}
+		start, end := loc[0], loc[1]
+		if !emphasisFlanked(text, start, end) {
+			// Look for another match starting within this one.
+			_, size := utf8.DecodeRuneInString(text[start:])
+			sb.WriteString(text[:start+size])
+			text = text[start+size:]
+			continue
+		}
+		inner := ""
+		if loc[2] >= 0 {
+			inner = text[loc[2]:loc[3]]
+		} else if len(loc) > 5 && loc[4] >= 0 {
+			inner = text[loc[4]:loc[5]]
+		}
+		sb.WriteString(text[:start])
+		sb.WriteString(r.wrap(code, inner))
+		text = text[end:]
+	}
+	sb.WriteString(text)
+	return sb.String()
+}
+
+// emphasisFlanked reports whether the emphasis markers at text[start] and
+// before text[end] are not next to letters or digits outside of them, nor
+// to more of the same marker, as in the rest of "2**3**4".
+func emphasisFlanked(text string, start, end int) bool {
+	marker := rune(text[start])
+	flanking := func(r rune) bool {
+		return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == marker)
+	}
+	if before, _ := utf8.DecodeLastRuneInString(text[:start]); flanking(before) {
+		return false
+	}
+	if after, _ := utf8.DecodeRuneInString(text[end:]); flanking(after) {
+		return false
+	}
+	return true
+}
+
+func (r markdownRenderer) link(text, url string) string {
+	if text == "" || text == url {
+		return r.color(url)
+	}
+	return fmt.Sprintf("%s (%s)", text, r.color(url))
+}
+
+func (r markdownRenderer) color(url string) string {
+	if !r.format {
+		return url
+	}
+	return ircColor + ircLinkColor + url + ircColor
+}
+
+// table renders Markdown table rows as text with aligned columns.
+func (r markdownRenderer) table(rows []string) []string {
+	if r.dropTables {
+		return nil
+	}
+
+	var cells [][]string
+	var widths []int
+	header := -1
+	for i, row := range rows {
+		if tableSepRegexp.MatchString(row) {
+			if i == 1 {
+				header = 0
+			}
+			continue
+		}
+		row = strings.TrimSpace(row)
+		row = strings.TrimSuffix(strings.TrimPrefix(row, "|"), "|")
+		var rendered []string
+		for j, cell := range strings.Split(row, "|") {
+			cell = r.inline(strings.TrimSpace(cell))
+			rendered = append(rendered, cell)
+			if j >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := visibleWidth(cell); w > widths[j] {
+				widths[j] = w
+			}
+		}
+		cells = append(cells, rendered)
+	}
+
+	var out []string
+	for i, row := range cells {
+		padded := make([]string, len(row))
+		for j, cell := range row {
+			padded[j] = cell
+			if j < len(row)-1 {
+				padded[j] += strings.Repeat(" ", widths[j]-visibleWidth(cell))
+			}
+		}
+		line := strings.Join(padded, " | ")
+		if i == header {
+			line = r.wrap(ircBold, line)
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// visibleWidth counts the characters in s that take up space, ignoring IRC
+// formatting codes.
+func visibleWidth(s string) int {
+	return utf8.RuneCountInString(stripIRCFormatting(s))
+}
+
+var ircFormattingRegexp = regexp.MustCompile("\x03(\\d{1,2}(,\\d{1,2})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]")
+
+func stripIRCFormatting(s string) string {
+	return ircFormattingRegexp.ReplaceAllString(s, "")
+}
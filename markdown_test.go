@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		mode       string
+		dropTables bool
+		want       string
+	}{
+		{"none", "**bold**", "none", false, "**bold**"},
+		{"bold", "a **b** c", "irc", false, "a \x02b\x02 c"},
+		{"bold underscores", "__b__", "irc", false, "\x02b\x02"},
+		{"italic", "a *it is* b", "irc", false, "a \x1dit is\x1d b"},
+		{"italic underscores", "_it_ and _more_", "irc", false, "\x1dit\x1d and \x1dmore\x1d"},
+		{"two italics", "*x* and *y*", "irc", false, "\x1dx\x1d and \x1dy\x1d"},
+		{"multiplication", "2*3*4", "irc", false, "2*3*4"},
+		{"intraword bold", "2**3**4", "irc", false, "2**3**4"},
+		{"snake case", "snake_case_name", "irc", false, "snake_case_name"},
+		{"lone asterisk", "a * b", "irc", false, "a * b"},
+		{"strikethrough", "~~old~~", "irc", false, "\x1eold\x1e"},
+		{"code span", "run `a *b* c`", "irc", false, "run \x11a *b* c\x11"},
+		{"link", "[docs](https://example.com)", "irc", false, "docs (\x0312https://example.com\x03)"},
+		{"bare link", "[https://example.com](https://example.com)", "irc", false, "\x0312https://example.com\x03"},
+		{"image", "![](https://example.com/a.png)", "strip", false, "https://example.com/a.png"},
+		{"header", "# Title", "irc", false, "\x1f\x02Title\x02\x1f"},
+		{"subheader", "## Part ##", "irc", false, "\x02Part\x02"},
+		{"rule", "a\n---\nb", "irc", false, "a\n\nb"},
+		{"quote", "> said", "irc", false, "> \x1dsaid\x1d"},
+		{"bullets", "- one\n  * two", "strip", false, "• one\n  • two"},
+		{"tasks", "- [ ] todo\n- [x] done", "strip", false, "[ ] todo\n[x] done"},
+		{"numbered", "1) one\n2. two", "strip", false, "1. one\n2. two"},
+		{"strip", "**b** *i* `c` [l](u)", "strip", false, "b i c l (u)"},
+		{"code block", "```go\nx := 1\n\n\ty\n```", "strip", false, "x := 1\n" + keptBlankLine + "\n    y"},
+		{"code block formatting", "```\na *b*\n```", "irc", false, "\x11a *b*\x11"},
+		{"table", "| a | bb |\n|---|---|\n| ccc | d |", "strip", false, "a   | bb\nccc | d"},
+		{"table header", "| a | b |\n|---|---|\n| c | d |", "irc", false, "\x02a | b\x02\nc | d"},
+		{"dropped table", "x\n| a | b |\n| c | d |\ny", "strip", true, "x\ny"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdown(tt.text, tt.mode, tt.dropTables); got != tt.want {
+				t.Errorf("renderMarkdown(%q, %q) = %q, want %q", tt.text, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVisibleWidth(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"abc", 3},
+		{"\x02abc\x02", 3},
+		{"\x0312,01abc\x03", 3},
+		{"日本", 2},
+	}
+	for _, tt := range tests {
+		if got := visibleWidth(tt.s); got != tt.want {
+			t.Errorf("visibleWidth(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
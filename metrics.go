@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics are exposed in the Prometheus text format on the address set by
+// "metrics_address" in config.json. Every metric is labelled by channel and
+// profile, with some metrics adding a label of their own.
+
+type metricVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newMetricVec(kind, name, help string, buckets []float64, labelNames ...string) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		values:     make(map[string]*metricValue),
+	}
+}
+
+func (m *metricVec) get(labelValues []string) *metricValue {
+	key := strings.Join(labelValues, "\xff")
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == "histogram" {
+			v.counts = make([]uint64, len(m.buckets))
+		}
+		m.values[key] = v
+	}
+	return v
+}
+
+func (m *metricVec) Add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += delta
+}
+
+// Total returns the sum of the values for every label.
+func (m *metricVec) Total() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total := 0.0
+	for _, v := range m.values {
+		total += v.value
+	}
+	return total
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metricVec) Set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = value
+}
+
+func (m *metricVec) Observe(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v := m.get(labelValues)
+	for i, bound := range m.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.sum += value
+	v.count++
+}
+
+func (m *metricVec) write(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(sb, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := m.values[key]
+		labels := formatLabels(m.labelNames, v.labelValues)
+		if m.kind != "histogram" {
+			fmt.Fprintf(sb, "%s%s %g\n", m.name, wrapLabels(labels), v.value)
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name, wrapLabels(joinLabels(labels, fmt.Sprintf(`le="%g"`, bound))), v.counts[i])
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name, wrapLabels(joinLabels(labels, `le="+Inf"`)), v.count)
+		fmt.Fprintf(sb, "%s_sum%s %g\n", m.name, wrapLabels(labels), v.sum)
+		fmt.Fprintf(sb, "%s_count%s %d\n", m.name, wrapLabels(labels), v.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+type Metrics struct {
+	MessagesReceived  *metricVec
+	MessagesAnswered  *metricVec
+	MessagesDropped   *metricVec
+	MessagesThrottled *metricVec
+	Commands          *metricVec
+	APIErrors         *metricVec
+	APILatency        *metricVec
+	ResponseLength    *metricVec
+	HistorySize       *metricVec
+	QueueDepth        *metricVec
+	Moderated         *metricVec
+	InjectionAttempts *metricVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		MessagesReceived:  newMetricVec("counter", "nisaba_messages_received_total", "Messages addressed to the bot.", nil, "channel", "profile"),
+		MessagesAnswered:  newMetricVec("counter", "nisaba_messages_answered_total", "Messages answered by the bot.", nil, "channel", "profile"),
+		MessagesDropped:   newMetricVec("counter", "nisaba_messages_dropped_total", "Messages ignored while the bot was busy.", nil, "channel", "profile"),
+		MessagesThrottled: newMetricVec("counter", "nisaba_messages_throttled_total", "Messages ignored due to rate limits.", nil, "channel", "profile"),
+		Commands:          newMetricVec("counter", "nisaba_commands_total", "Commands handled by the bot.", nil, "channel", "profile", "command"),
+		APIErrors:         newMetricVec("counter", "nisaba_api_errors_total", "Errors while calling the API endpoint.", nil, "channel", "profile", "type"),
+		APILatency:        newMetricVec("histogram", "nisaba_api_latency_seconds", "Time taken by the API endpoint to respond.", []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "channel", "profile"),
+		ResponseLength:    newMetricVec("histogram", "nisaba_response_length_bytes", "Length of responses returned by the API endpoint.", []float64{50, 100, 250, 500, 1000, 2500, 5000, 10000}, "channel", "profile"),
+		HistorySize:       newMetricVec("gauge", "nisaba_history_messages", "Messages stored in the conversation history.", nil, "channel", "profile"),
+		QueueDepth:        newMetricVec("gauge", "nisaba_queue_depth", "Messages waiting on a response from the API endpoint.", nil, "channel", "profile"),
+		Moderated:         newMetricVec("counter", "nisaba_moderation_actions_total", "Messages and responses changed or stopped by moderation.", nil, "channel", "profile", "direction", "action"),
+		InjectionAttempts: newMetricVec("counter", "nisaba_injection_attempts_total", "Messages flagged as possible prompt injection.", nil, "channel", "profile", "action"),
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var sb strings.Builder
+	for _, vec := range []*metricVec{
+		m.MessagesReceived,
+		m.MessagesAnswered,
+		m.MessagesDropped,
+		m.MessagesThrottled,
+		m.Commands,
+		m.APIErrors,
+		m.APILatency,
+		m.ResponseLength,
+		m.HistorySize,
+		m.QueueDepth,
+		m.Moderated,
+		m.InjectionAttempts,
+	} {
+		vec.write(&sb)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, sb.String())
+}
+
+var metrics = NewMetrics()
+
+func startMetricsServer(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		slog.Info("Serving metrics", "address", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			slog.Error("Metrics server stopped", "error", err)
+		}
+	}()
+}
+
+// metricLabels returns the channel and profile labels, followed by extra.
+// Direct messages share the channel label "direct", so each nickname does
+// not add a series.
+func (conv *Conversation) metricLabels(extra ...string) []string {
+	channel := conv.Target
+	if conv.isDirect() {
+		channel = "direct"
+	}
+	return append([]string{channel, conv.profileLabel()}, extra...)
+}
+
+func recordHistorySize(conv *Conversation) {
+	metrics.HistorySize.Set(float64(len(loadMessageHistory(conv))), conv.metricLabels()...)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// modelsURLs returns the endpoints tried when listing models: "models_url"
+// if it is set, otherwise the OpenAI compatible "/v1/models" and the Ollama
+// "/api/tags" endpoints on the host of "api_url".
+func (bot *Bot) modelsURLs() ([]string, error) {
+	if *bot.Config.ModelsURL != "" {
+		return []string{*bot.Config.ModelsURL}, nil
+	}
+	apiURL, err := url.Parse(*bot.Config.APIURL)
+	if err != nil {
+		return nil, err
+	}
+	base := apiURL.Scheme + "://" + apiURL.Host
+	return []string{base + "/v1/models", base + "/api/tags"}, nil
+}
+
+// listModels returns the names of the models served by the API endpoint.
+func (bot *Bot) listModels(ctx context.Context) ([]string, error) {
+	urls, err := bot.modelsURLs()
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, modelsURL := range urls {
+		models, err := bot.fetchModels(ctx, modelsURL)
+		if err == nil {
+			sort.Strings(models)
+			return models, nil
+		}
+		loggerFrom(ctx).Debug("Error listing models", "url", modelsURL, "error", err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (bot *Bot) fetchModels(ctx context.Context, modelsURL string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", modelsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+*bot.Config.APIKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("models endpoint returned %s", resp.Status)
+	}
+
+	// OpenAI compatible servers return "data", Ollama returns "models".
+	var response struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	var models []string
+	for _, model := range response.Data {
+		models = append(models, model.ID)
+	}
+	for _, model := range response.Models {
+		models = append(models, model.Name)
+	}
+	if models == nil {
+		return nil, fmt.Errorf("models endpoint returned no models")
+	}
+	return models, nil
+}
+
+// modelAllowed reports whether the profile allows a model. Without a
+// "models" list in "profile.json" any model served by the endpoint is.
+func (conv *Conversation) modelAllowed(model string) bool {
+	if len(conv.Settings.Models) == 0 {
+		return true
+	}
+	_, ok := containsFold(conv.Settings.Models, model)
+	return ok
+}
+
+func containsFold(list []string, s string) (string, bool) {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return item, true
+		}
+	}
+	return "", false
+}
+
+// applyModel sets the model in a chat payload, if one is selected.
+func applyModel(payload map[string]interface{}, conv *Conversation) {
+	if conv.Model != "" {
+		payload["model"] = conv.Model
+	}
+}
+
+func listModelsCommand(bot *Bot, conv *Conversation, user string) {
+	models, err := bot.listModels(context.Background())
+	if err != nil {
+		sendMessage(conv.Target, fmt.Sprintf("%s: Error listing models: %s", user, err))
+		return
+	}
+	var names []string
+	for _, model := range models {
+		if !conv.modelAllowed(model) {
+			continue
+		}
+		if model == conv.Model {
+			model += " (active)"
+		}
+		names = append(names, model)
+	}
+	if len(names) == 0 {
+		sendMessage(conv.Target, fmt.Sprintf("%s: None of the models served by the endpoint are allowed for this profile.", user))
+		return
+	}
+	sendMessage(conv.Target, fmt.Sprintf("%s: Models: %s", user, strings.Join(names, ", ")))
+}
+
+// handleModelCommand shows or changes the model of the conversation. The
+// name "default" returns to the profile's default model.
+func handleModelCommand(bot *Bot, conv *Conversation, query, user string) {
+	name := strings.TrimSpace(query)
+	if name == "" {
+		model := conv.Model
+		if model == "" {
+			model = "the endpoint's default"
+		}
+		sendMessage(conv.Target, fmt.Sprintf("%s: The model is %s.", user, model))
+		return
+	}
+
+	model := ""
+	if !strings.EqualFold(name, "default") {
+		if !conv.modelAllowed(name) {
+			sendMessage(conv.Target, fmt.Sprintf("%s: The model '%s' is not allowed for this profile.", user, name))
+			return
+		}
+		models, err := bot.listModels(context.Background())
+		if err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error listing models: %s", user, err))
+			return
+		}
+		var ok bool
+		if model, ok = containsFold(models, name); !ok {
+			sendMessage(conv.Target, fmt.Sprintf("%s: The model '%s' is not served by the endpoint. Use '!models' to list the models.", user, name))
+			return
+		}
+	}
+
+	// Listing models takes time, so start from the conversation as it is
+	// now rather than undo any change made in the meantime.
+	newConv := *bot.conversation(conv.Target)
+	if model == "" {
+		newConv.Model = newConv.Settings.Model
+	} else if !newConv.modelAllowed(model) {
+		sendMessage(conv.Target, fmt.Sprintf("%s: The model '%s' is not allowed for this profile.", user, model))
+		return
+	} else {
+		newConv.Model = model
+	}
+	if err := bot.setConversation(&newConv); err != nil {
+		slog.Error("Error saving conversation", "target", conv.Target, "error", err)
+		sendMessage(conv.Target, fmt.Sprintf("%s: Error saving model: %s", user, err))
+		return
+	}
+	slog.Info("Model changed", "target", conv.Target, "model", newConv.Model, "by", user)
+	model = newConv.Model
+	if model == "" {
+		model = "the endpoint's default"
+	}
+	sendMessage(conv.Target, fmt.Sprintf("%s: The model is now %s.", user, model))
+}
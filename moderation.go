@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ModerationConfig filters user messages before they are sent to the model,
+// and the model's responses before they are sent to IRC.
+type ModerationConfig struct {
+	Rules            []*ModerationRule `json:"rules"`
+	Classifier       string            `json:"classifier"`
+	ClassifierAction string            `json:"classifier_action"`
+	ClassifierReply  string            `json:"classifier_reply"`
+	BlockMessage     string            `json:"block_message"`
+	RedactText       string            `json:"redact_text"`
+}
+
+// ModerationRule matches a regular expression, a list of words, or both.
+type ModerationRule struct {
+	Name      string   `json:"name"`
+	Pattern   string   `json:"pattern"`
+	Words     []string `json:"words"`
+	WordsFile string   `json:"words_file"`
+	Apply     string   `json:"apply"`
+	Action    string   `json:"action"`
+	Reply     string   `json:"reply"`
+
+	re *regexp.Regexp
+}
+
+const defaultModerationPrompt = `You are a content moderator for a public chat channel. Decide whether the text you are given is abusive, hateful, sexually explicit, or encourages violence or self-harm. Reply with only FLAG if it is, or OK if it is not.`
+
+// screenInput runs input moderation and the injection guard on text from a
+// user, returning the text to use, or the reply to send if stop is true.
+func (bot *Bot) screenInput(ctx context.Context, conv *Conversation, user, text string) (string, bool) {
+	_, text, stop := bot.guardedInput(ctx, conv, user, text)
+	return text, stop
+}
+
+// guardedInput is screenInput for a message that is answered, returning
+// the context to answer it with.
+func (bot *Bot) guardedInput(ctx context.Context, conv *Conversation, user, text string) (context.Context, string, bool) {
+	text, stop := bot.moderate(ctx, conv, "input", user, text)
+	if stop {
+		return ctx, text, true
+	}
+	return bot.guardInput(ctx, conv, user, text)
+}
+
+// compileModeration checks the moderation settings and compiles each rule
+// into a single regular expression, reading "words_file" once at startup.
+func compileModeration(m *ModerationConfig) error {
+	for i, rule := range m.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if !validModerationApply(rule.Apply) {
+			return fmt.Errorf("%s: unknown apply '%s'", rule.Name, rule.Apply)
+		}
+		switch rule.Action {
+		case "block", "redact":
+		case "replace":
+			if rule.Reply == "" {
+				return fmt.Errorf("%s: the replace action requires a reply", rule.Name)
+			}
+		default:
+			return fmt.Errorf("%s: unknown action '%s'", rule.Name, rule.Action)
+		}
+
+		words := rule.Words
+		if rule.WordsFile != "" {
+			fileWords, err := readWordList(rule.WordsFile)
+			if err != nil {
+				return fmt.Errorf("%s: %w", rule.Name, err)
+			}
+			words = append(words, fileWords...)
+		}
+		var alternatives []string
+		if rule.Pattern != "" {
+			alternatives = append(alternatives, "(?:"+rule.Pattern+")")
+		}
+		if len(words) > 0 {
+			quoted := make([]string, len(words))
+			for j, word := range words {
+				quoted[j] = regexp.QuoteMeta(word)
+			}
+			alternatives = append(alternatives, `(?i)\b(?:`+strings.Join(quoted, "|")+`)\b`)
+		}
+		if len(alternatives) == 0 {
+			return fmt.Errorf("%s: either pattern or words is required", rule.Name)
+		}
+		re, err := regexp.Compile(strings.Join(alternatives, "|"))
+		if err != nil {
+			return fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		rule.re = re
+	}
+	if m.Classifier != "" && !validModerationApply(m.Classifier) {
+		return fmt.Errorf("unknown classifier setting '%s'", m.Classifier)
+	}
+	switch m.ClassifierAction {
+	case "block":
+	case "replace":
+		if m.ClassifierReply == "" {
+			return fmt.Errorf("the replace classifier action requires a classifier_reply")
+		}
+	default:
+		return fmt.Errorf("unknown classifier action '%s'", m.ClassifierAction)
+	}
+	return nil
+}
+
+func validModerationApply(apply string) bool {
+	return apply == "" || apply == "input" || apply == "output" || apply == "both"
+}
+
+func moderationApplies(apply, direction string) bool {
+	return apply == "" || apply == "both" || apply == direction
+}
+
+func readWordList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// moderate applies the moderation rules, then the classifier, to text going
+// in the given direction, "input" or "output". It returns the text to use,
+// which may be redacted, or the reply to send in its place if stop is true.
+func (bot *Bot) moderate(ctx context.Context, conv *Conversation, direction, user, text string) (result string, stop bool) {
+	m := bot.Config.Moderation
+	if m == nil {
+		return text, false
+	}
+	logger := loggerFrom(ctx)
+	contentKey := "message"
+	if direction == "output" {
+		contentKey = "response"
+	}
+
+	for _, rule := range m.Rules {
+		if !moderationApplies(rule.Apply, direction) || !rule.re.MatchString(text) {
+			continue
+		}
+		metrics.Moderated.Inc(conv.metricLabels(direction, rule.Action)...)
+		logger.Warn("Moderation rule matched", "rule", rule.Name, "direction", direction, "action", rule.Action, "nick", user, contentKey, text)
+		switch rule.Action {
+		case "redact":
+			text = rule.re.ReplaceAllLiteralString(text, m.RedactText)
+		case "replace":
+			return rule.Reply, true
+		default:
+			return m.BlockMessage, true
+		}
+	}
+
+	if m.Classifier == "" || !moderationApplies(m.Classifier, direction) {
+		return text, false
+	}
+	flagged, err := bot.classify(ctx, conv, text)
+	if err != nil {
+		// Fail open, so an unavailable classifier does not silence the bot.
+		logger.Error("Moderation classifier failed", "direction", direction, "error", err)
+		return text, false
+	}
+	if !flagged {
+		return text, false
+	}
+	metrics.Moderated.Inc(conv.metricLabels(direction, m.ClassifierAction)...)
+	logger.Warn("Moderation classifier flagged text", "direction", direction, "action", m.ClassifierAction, "nick", user, contentKey, text)
+	if m.ClassifierAction == "replace" {
+		return m.ClassifierReply, true
+	}
+	return m.BlockMessage, true
+}
+
+// classify asks the model whether text should be blocked, using the prompt
+// in "moderationprompt.txt" and the options in "options.moderation.json" if
+// they exist.
+func (bot *Bot) classify(ctx context.Context, conv *Conversation, text string) (bool, error) {
+	prompt := defaultModerationPrompt
+	if content, err := os.ReadFile(conv.configFilePath("moderationprompt.txt")); err == nil {
+		prompt = string(content)
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	options := conv.Options
+	if moderationOptions, err := loadOptions(conv, "options.moderation.json"); err == nil {
+		options = moderationOptions
+	}
+
+	reply, err := bot.completeWith(ctx, conv, []Message{
+		{Role: "system", Content: prompt},
+		{Role: "user", Content: text},
+	}, options)
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(strings.ToUpper(reply), "FLAG"), nil
+}
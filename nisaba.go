@@ -1,19 +1,24 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type Config struct {
@@ -27,9 +32,56 @@ type Config struct {
 	Debug       *bool   `json:"debug"`
 	APIURL      *string `json:"api_url"`
 	APIKey      *string `json:"api_key"`
+	ModelsURL   *string `json:"models_url"`
 	APIMode     *string `json:"api_mode"`
 	MessageSize *int    `json:"message_size"`
 	Delay       *int    `json:"delay"`
+	MetricsAddr *string `json:"metrics_address"`
+	LogLevel    *string `json:"log_level"`
+	LogFormat   *string `json:"log_format"`
+	LogFile     *string `json:"log_file"`
+	LogMaxSize  *int    `json:"log_max_size"`
+	LogBackups  *int    `json:"log_max_backups"`
+	LogRedact   *bool   `json:"log_redact_content"`
+
+	UserRateLimit    *RateLimit `json:"user_rate_limit"`
+	ChannelRateLimit *RateLimit `json:"channel_rate_limit"`
+	OutputRateLimit  *RateLimit `json:"output_rate_limit"`
+	ThrottleMessage  *string    `json:"throttle_message"`
+
+	PreserveParagraphs *bool `json:"preserve_paragraphs"`
+	ContinuationMarker *bool `json:"continuation_marker"`
+
+	Paste *PasteConfig `json:"paste"`
+
+	Formatting *string `json:"formatting"`
+	DropTables *bool   `json:"drop_tables"`
+
+	RAG *RAGConfig `json:"rag"`
+
+	MemoryExtraction *bool `json:"memory_extraction"`
+
+	ImageMaxBytes  *int     `json:"image_max_bytes"`
+	ImageLocalDirs []string `json:"image_local_dirs"`
+
+	Tools             map[string][]string `json:"tools"`
+	MaxToolIterations *int                `json:"max_tool_iterations"`
+
+	Aliases         []string `json:"aliases"`
+	AddressAnywhere *bool    `json:"address_anywhere"`
+	CommandPrefix   *string  `json:"command_prefix"`
+	ReplyWindow     *int     `json:"reply_window"`
+
+	Admins        []string `json:"admins"`
+	AllowlistOnly *bool    `json:"allowlist_only"`
+
+	Moderation *ModerationConfig `json:"moderation"`
+
+	SystemCommand  *string               `json:"system_command"`
+	InjectionGuard *InjectionGuardConfig `json:"injection_guard"`
+
+	Backend     *BackendConfig     `json:"backend"`
+	HealthCheck *HealthCheckConfig `json:"health_check"`
 }
 
 type Options struct {
@@ -58,35 +110,82 @@ type Options struct {
 	SystemPrompt     *string  `json:"system_prompt,omitempty"`
 }
 
+// ProfileSettings are settings read from "profile.json" that apply to the
+// active profile rather than to the whole bot.
+type ProfileSettings struct {
+	Vision         *bool    `json:"vision"`
+	PromptTemplate string   `json:"prompt_template"`
+	Stop           []string `json:"stop"`
+	Model          string   `json:"model"`
+	Models         []string `json:"models"`
+	// Formatting replaces "formatting" from config.json, for channels
+	// that block formatting codes with +c.
+	Formatting string `json:"formatting"`
+}
+
 type Bot struct {
 	Config      Config
-	Options     *Options
 	IsAvailable bool
+	Started     time.Time
+
+	conversationsMu sync.Mutex
+	conversations   map[string]*Conversation
+	// lastUsed is when each direct message conversation was last used, so
+	// idle ones can be dropped.
+	lastUsed map[string]time.Time
+
+	// backend is set when Nisaba runs the API endpoint itself.
+	backend *Supervisor
+	health  *HealthMonitor
 }
 
 func NewBot(config Config) *Bot {
 	return &Bot{
-		Config:      config,
-		IsAvailable: true,
+		Config:        config,
+		IsAvailable:   true,
+		Started:       time.Now(),
+		conversations: make(map[string]*Conversation),
+		lastUsed:      make(map[string]time.Time),
 	}
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Name       string     `json:"name,omitempty"`
 }
 
 var sendMessage func(channel, message string)
 
+// getConfigFilePath returns the path of a file in the default configuration.
+// Files that may be set for each profile are read with configFilePath.
 func getConfigFilePath(fileName string) string {
-	if profileDir != "" {
-		profilePath := filepath.Join("profiles", profileDir, fileName)
+	return getProfileConfigFilePath("", fileName)
+}
+
+// savedFileRegexp matches the configuration files that commands save:
+// options and presets, the block list and the system prompt. With
+// "--data-dir" they are saved there, so they are read from there first.
+var savedFileRegexp = regexp.MustCompile(`^(?:options(?:\.[a-zA-Z0-9]+)?\.json|blocklist\.txt|systemprompt\.txt)$`)
+
+// getProfileConfigFilePath is getConfigFilePath for the named profile, or
+// for the default configuration if profile is empty.
+func getProfileConfigFilePath(profile, fileName string) string {
+	if dataDir != "" && savedFileRegexp.MatchString(fileName) {
+		dataPath := filepath.Join(getProfileDataDir(profile), fileName)
+		if _, err := os.Stat(dataPath); err == nil {
+			return dataPath
+		}
+	}
+	if profile != "" {
+		profilePath := filepath.Join("profiles", profile, fileName)
 		if _, err := os.Stat(profilePath); err == nil {
 			return profilePath
 		}
 	}
 
-	configDir := "config"
 	defaultPath := filepath.Join(configDir, fileName)
 	if _, err := os.Stat(defaultPath); err == nil {
 		return defaultPath
@@ -99,26 +198,35 @@ func getConfigFilePath(fileName string) string {
 	return filepath.Join(configDir, fileName)
 }
 
+// loadConfig reads config.json, then applies NISABA_* environment variables.
+// Without config.json, every mandatory setting must come from the
+// environment.
 func loadConfig() Config {
 	var config Config
-	configPath := getConfigFilePath("config.json")
+	configPath := configFile
+	if configPath == "" {
+		configPath = getConfigFilePath("config.json")
+	}
 	file, err := os.Open(configPath)
-	if err != nil {
-		log.Fatalf("Error opening config file: %v", err)
+	if err == nil {
+		defer file.Close()
+		decoder := json.NewDecoder(file)
+		if err := decoder.Decode(&config); err != nil {
+			fatal("Error decoding config file", "error", err)
+		}
+	} else if configFile != "" || !os.IsNotExist(err) {
+		fatal("Error opening config file", "error", err)
 	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
-		log.Fatalf("Error decoding config file: %v", err)
+	if err := applyEnvironment(&config); err != nil {
+		fatal("Invalid environment variable", "error", err)
 	}
 
 	// Validate mandatory fields
 	if config.Server == "" {
-		log.Fatalf("Mandatory configuration missing: 'server' is not set in config.json")
+		fatal("Mandatory configuration missing: 'server' is not set in config.json or NISABA_SERVER")
 	}
 	if config.Channel == "" {
-		log.Fatalf("Mandatory configuration missing: 'channel' is not set in config.json")
+		fatal("Mandatory configuration missing: 'channel' is not set in config.json or NISABA_CHANNEL")
 	}
 
 	// Set defaults for optional fields if not present
@@ -138,6 +246,10 @@ func loadConfig() Config {
 		defaultAPIKey := "null"
 		config.APIKey = &defaultAPIKey
 	}
+	if config.ModelsURL == nil {
+		defaultModelsURL := ""
+		config.ModelsURL = &defaultModelsURL
+	}
 	if config.APIMode == nil {
 		defaultAPIMode := "chat"
 		config.APIMode = &defaultAPIMode
@@ -162,12 +274,172 @@ func loadConfig() Config {
 		defaultDelay := 3
 		config.Delay = &defaultDelay
 	}
+	if config.Debug == nil {
+		defaultDebug := false
+		config.Debug = &defaultDebug
+	}
+	if config.MetricsAddr == nil {
+		defaultMetricsAddr := ""
+		config.MetricsAddr = &defaultMetricsAddr
+	}
+	if config.LogLevel == nil {
+		defaultLogLevel := "info"
+		config.LogLevel = &defaultLogLevel
+	}
+	if config.LogFormat == nil {
+		defaultLogFormat := "text"
+		config.LogFormat = &defaultLogFormat
+	}
+	if config.LogFile == nil {
+		defaultLogFile := ""
+		config.LogFile = &defaultLogFile
+	}
+	if config.LogMaxSize == nil || *config.LogMaxSize < 1 {
+		defaultLogMaxSize := 10
+		config.LogMaxSize = &defaultLogMaxSize
+	}
+	if config.LogBackups == nil || *config.LogBackups < 0 {
+		defaultLogBackups := 3
+		config.LogBackups = &defaultLogBackups
+	}
+	if config.LogRedact == nil {
+		defaultLogRedact := false
+		config.LogRedact = &defaultLogRedact
+	}
+	if config.UserRateLimit == nil {
+		config.UserRateLimit = &RateLimit{Rate: 6, Burst: 3}
+	}
+	if config.ChannelRateLimit == nil {
+		config.ChannelRateLimit = &RateLimit{Rate: 20, Burst: 10}
+	}
+	if config.OutputRateLimit == nil {
+		config.OutputRateLimit = &RateLimit{Rate: 30, Burst: 5}
+	}
+	if config.PreserveParagraphs == nil {
+		defaultPreserveParagraphs := true
+		config.PreserveParagraphs = &defaultPreserveParagraphs
+	}
+	if config.ContinuationMarker == nil {
+		defaultContinuationMarker := false
+		config.ContinuationMarker = &defaultContinuationMarker
+	}
+	if config.Formatting == nil {
+		defaultFormatting := "irc"
+		config.Formatting = &defaultFormatting
+	}
+	if config.DropTables == nil {
+		defaultDropTables := false
+		config.DropTables = &defaultDropTables
+	}
+	if config.MaxToolIterations == nil || *config.MaxToolIterations < 0 {
+		defaultMaxToolIterations := 5
+		config.MaxToolIterations = &defaultMaxToolIterations
+	}
+	if config.RAG != nil {
+		if config.RAG.TopK < 1 {
+			config.RAG.TopK = 3
+		}
+		if config.RAG.ChunkSize < 100 {
+			config.RAG.ChunkSize = 1000
+		}
+		if config.RAG.ChunkOverlap < 0 || config.RAG.ChunkOverlap >= config.RAG.ChunkSize {
+			config.RAG.ChunkOverlap = 100
+		}
+	}
+	if config.Moderation != nil {
+		if config.Moderation.ClassifierAction == "" {
+			config.Moderation.ClassifierAction = "block"
+		}
+		if config.Moderation.BlockMessage == "" {
+			config.Moderation.BlockMessage = "Sorry, I can't help with that."
+		}
+		if config.Moderation.RedactText == "" {
+			config.Moderation.RedactText = "[redacted]"
+		}
+		if err := compileModeration(config.Moderation); err != nil {
+			fatal("Invalid moderation settings in config.json", "error", err)
+		}
+	}
+	admins := config.Admins[:0]
+	for _, mask := range config.Admins {
+		if !validAdminMask(mask) {
+			slog.Warn("Ignoring admin without a hostmask or account", "mask", mask)
+			continue
+		}
+		admins = append(admins, mask)
+	}
+	config.Admins = admins
+	if config.SystemCommand == nil {
+		defaultSystemCommand := "admins"
+		config.SystemCommand = &defaultSystemCommand
+	}
+	if config.Backend != nil {
+		if config.Backend.StartupTimeout < 1 {
+			config.Backend.StartupTimeout = 300
+		}
+		if config.Backend.RestartDelay < 1 {
+			config.Backend.RestartDelay = 5
+		}
+	}
+	if config.Paste != nil {
+		if config.Paste.PreviewLines < 1 {
+			config.Paste.PreviewLines = 2
+		}
+		if config.Paste.MaxAge < 1 {
+			config.Paste.MaxAge = 168
+		}
+		if config.Paste.MaxPastes < 1 {
+			config.Paste.MaxPastes = 1000
+		}
+	}
+	if config.HealthCheck != nil && config.HealthCheck.Interval < 1 {
+		config.HealthCheck.Interval = 30
+	}
+	if config.InjectionGuard != nil {
+		if config.InjectionGuard.Threshold < 1 {
+			config.InjectionGuard.Threshold = 1
+		}
+		if config.InjectionGuard.BlockMessage == "" {
+			config.InjectionGuard.BlockMessage = "Sorry, I can't follow instructions that try to change how I work."
+		}
+		if err := compileInjectionGuard(config.InjectionGuard); err != nil {
+			fatal("Invalid injection_guard settings in config.json", "error", err)
+		}
+	}
+	if config.ImageMaxBytes == nil || *config.ImageMaxBytes < 1 {
+		defaultImageMaxBytes := 5 * 1024 * 1024
+		config.ImageMaxBytes = &defaultImageMaxBytes
+	}
+	if config.MemoryExtraction == nil {
+		defaultMemoryExtraction := false
+		config.MemoryExtraction = &defaultMemoryExtraction
+	}
+	if config.AddressAnywhere == nil {
+		defaultAddressAnywhere := false
+		config.AddressAnywhere = &defaultAddressAnywhere
+	}
+	if config.CommandPrefix == nil {
+		defaultCommandPrefix := ""
+		config.CommandPrefix = &defaultCommandPrefix
+	}
+	if config.ReplyWindow == nil || *config.ReplyWindow < 0 {
+		defaultReplyWindow := 0
+		config.ReplyWindow = &defaultReplyWindow
+	}
+	if config.AllowlistOnly == nil {
+		defaultAllowlistOnly := false
+		config.AllowlistOnly = &defaultAllowlistOnly
+	}
+	if config.ThrottleMessage == nil {
+		defaultThrottleMessage := "You are sending messages too quickly, please wait a moment."
+		config.ThrottleMessage = &defaultThrottleMessage
+	}
 
 	return config
 }
 
-func loadOptions(fileName string) (*Options, error) {
-	filePath := getConfigFilePath(fileName)
+func loadOptions(conv *Conversation, fileName string) (*Options, error) {
+	filePath := conv.configFilePath(fileName)
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
@@ -182,165 +454,144 @@ func loadOptions(fileName string) (*Options, error) {
 	return &opts, nil
 }
 
-var profileDir string
-
-func loadProfile(bot *Bot, profileName string, user string) {
-	if profileName == "" {
-		profileDir = ""
-		opts, err := loadOptions("options.json")
-		if err == nil {
-			bot.Options = opts
-			log.Printf("Options file for API endpoint has been reloaded with default settings.")
-		}
-		loadMessageHistory()
-		loadBlockedUsers()
-		sendMessage(bot.Config.Channel, fmt.Sprintf("%s: Profile directory has been reset to default settings.", user))
-	} else if match, _ := regexp.MatchString(`^[a-zA-Z0-9]+$`, profileName); match {
-		dirPath := filepath.Join("profiles", profileName)
-		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: The directory does not exist: '%s'.", user, dirPath))
-		} else {
-			profileDir = profileName
-			opts, err := loadOptions("options.json")
-			if err == nil {
-				bot.Options = opts
-				log.Printf("Options file for API endpoint has been reloaded for profile '%s'.", profileName)
-			}
-			loadMessageHistory()
-			loadBlockedUsers()
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: Configuration directory is set to '%s'.", user, dirPath))
-		}
-	} else {
-		sendMessage(bot.Config.Channel, fmt.Sprintf("%s: Invalid directory name. Only alphanumeric characters are allowed.", user))
-	}
-}
-
-var blockedUsers map[string]bool
-
-func loadBlockedUsers() {
-	blockedUsers = make(map[string]bool)
-	filePath := getConfigFilePath("blocklist.txt")
+// loadProfileSettings reads "profile.json", returning empty settings if the
+// file does not exist.
+func loadProfileSettings(conv *Conversation) ProfileSettings {
+	var settings ProfileSettings
+	filePath := conv.configFilePath("profile.json")
 	file, err := os.Open(filePath)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			log.Printf("Error opening block list file: %v", err)
+			slog.Warn("Error opening profile settings file", "error", err)
 		}
-		return
+		return settings
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		blockedUsers[strings.TrimSpace(scanner.Text())] = true
+	if err := json.NewDecoder(file).Decode(&settings); err != nil {
+		slog.Warn("Error decoding profile settings file", "error", err)
 	}
+	return settings
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading block list file: %v", err)
+// loadProfile switches the profile of a conversation, or returns it to the
+// default configuration if profileName is empty. Other channels and direct
+// messages keep their own profiles.
+func loadProfile(bot *Bot, conv *Conversation, profileName string, user string) {
+	if profileName == "" {
+		newConv := bot.newConversation(conv.Target, "")
+		if err := bot.setConversation(newConv); err != nil {
+			slog.Error("Error saving active profile", "target", conv.Target, "error", err)
+		}
+		loadMessageHistory(newConv)
+		reloadAccessLists(newConv.Profile)
+		slog.Info("Profile reset to default settings.", "target", conv.Target)
+		sendMessage(conv.Target, fmt.Sprintf("%s: Profile directory has been reset to default settings.", user))
+	} else if profileNameRegexp.MatchString(profileName) {
+		dirPath := filepath.Join("profiles", profileName)
+		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+			sendMessage(conv.Target, fmt.Sprintf("%s: The directory does not exist: '%s'.", user, dirPath))
+		} else {
+			newConv := bot.newConversation(conv.Target, profileName)
+			if err := bot.setConversation(newConv); err != nil {
+				slog.Error("Error saving active profile", "target", conv.Target, "error", err)
+			}
+			loadMessageHistory(newConv)
+			reloadAccessLists(newConv.Profile)
+			slog.Info("Profile loaded.", "target", conv.Target, "profile", profileName)
+			sendMessage(conv.Target, fmt.Sprintf("%s: Configuration directory is set to '%s'.", user, dirPath))
+		}
+	} else {
+		sendMessage(conv.Target, fmt.Sprintf("%s: Invalid directory name. Only alphanumeric characters are allowed.", user))
 	}
 }
 
-func loadSystemPrompt() string {
-	filePath := getConfigFilePath("systemprompt.txt")
+func loadSystemPrompt(conv *Conversation) string {
+	filePath := conv.configFilePath("systemprompt.txt")
 	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return ""
 		}
-		log.Fatalf("Error reading system prompt file: %v", err)
+		fatal("Error reading system prompt file", "error", err)
 	}
 	return string(content)
 }
 
-func loadReminderPrompt() string {
-	filePath := getConfigFilePath("reminderprompt.txt")
+func loadReminderPrompt(conv *Conversation) string {
+	filePath := conv.configFilePath("reminderprompt.txt")
 	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return ""
 		}
-		log.Fatalf("Error reading reminder prompt file: %v", err)
+		fatal("Error reading reminder prompt file", "error", err)
 	}
 	return string(content)
 }
 
-func getHistoryFilePath() string {
-	var filePath = "history.txt"
-
-	if profileDir != "" {
-		customPath := filepath.Join("profiles", profileDir, "history.txt")
-		if _, err := os.Stat(filepath.Join("profiles", profileDir)); err == nil {
-			filePath = customPath
-		}
-	} else {
-		configPath := filepath.Join("config", "history.txt")
-		if _, err := os.Stat(filepath.Join("config")); err == nil {
-			filePath = configPath
-		}
-	}
-
-	return filePath
-}
-
-func createMessageHistory() {
-	filePath := getHistoryFilePath()
+func createMessageHistory(conv *Conversation) {
+	filePath := conv.historyFilePath()
 	var history []Message
-	systemPromptContent := loadSystemPrompt()
+	systemPromptContent := loadSystemPrompt(conv)
 	if systemPromptContent != "" {
 		initialSystemMessage := Message{Role: "system", Content: systemPromptContent}
 		history = append(history, initialSystemMessage)
 	}
 	fileContent, err := json.MarshalIndent(history, "", "  ")
 	if err != nil {
-		log.Fatalf("Error encoding message history: %v", err)
+		fatal("Error encoding message history", "error", err)
 	}
 	if err := ioutil.WriteFile(filePath, fileContent, 0644); err != nil {
-		log.Fatalf("Error writing initial message history: %v", err)
+		fatal("Error writing initial message history", "error", err)
 	}
 }
 
-func loadMessageHistory() []Message {
-	filePath := getHistoryFilePath()
+func loadMessageHistory(conv *Conversation) []Message {
+	filePath := conv.historyFilePath()
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		createMessageHistory()
+		createMessageHistory(conv)
 	}
 
 	fileContent, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		log.Fatalf("Error reading message history: %v", err)
+		fatal("Error reading message history", "error", err)
 	}
 	var history []Message
 	if err := json.Unmarshal(fileContent, &history); err != nil {
-		log.Fatalf("Error parsing message history: %v", err)
+		fatal("Error parsing message history", "error", err)
 	}
 	return history
 }
 
-func saveMessageHistory(newMessages []Message) {
-	filePath := getHistoryFilePath()
-	existingHistory := loadMessageHistory()
+func saveMessageHistory(conv *Conversation, newMessages []Message) {
+	filePath := conv.historyFilePath()
+	existingHistory := loadMessageHistory(conv)
 	updatedHistory := append(existingHistory, newMessages...)
 
 	fileContent, err := json.MarshalIndent(updatedHistory, "", "  ")
 	if err != nil {
-		log.Fatalf("Error encoding message history: %v", err)
+		fatal("Error encoding message history", "error", err)
 	}
 
 	if err := ioutil.WriteFile(filePath, fileContent, 0644); err != nil {
-		log.Fatalf("Error writing message history: %v", err)
+		fatal("Error writing message history", "error", err)
 	}
 }
 
-func saveHistoryArchive(index int) (int, error) {
-	basePath := getHistoryFilePath()
-	baseDir, baseName := filepath.Split(basePath)
-	extension := filepath.Ext(baseName)
-	baseName = baseName[:len(baseName)-len(extension)]
+// historyArchivePath returns the path of a history saved with "!save",
+// such as "history.1.txt".
+func (conv *Conversation) historyArchivePath(index int) string {
+	basePath := conv.historyFilePath()
+	extension := filepath.Ext(basePath)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(basePath, extension), index, extension)
+}
 
+func saveHistoryArchive(conv *Conversation, index int) (int, error) {
 	if index <= 0 {
 		index = 1
 		for {
-			historyArchivePath := fmt.Sprintf("%s%s.%d%s", baseDir, baseName, index, extension)
-			if _, err := os.Stat(historyArchivePath); os.IsNotExist(err) {
+			if _, err := os.Stat(conv.historyArchivePath(index)); os.IsNotExist(err) {
 				break
 			}
 			index++
@@ -351,26 +602,19 @@ func saveHistoryArchive(index int) (int, error) {
 		return 0, fmt.Errorf("index out of valid range")
 	}
 
-	historyArchivePath := fmt.Sprintf("%s%s.%d%s", baseDir, baseName, index, extension)
-	content, err := ioutil.ReadFile(basePath)
+	content, err := ioutil.ReadFile(conv.historyFilePath())
 	if err != nil {
 		return index, err
 	}
-	err = ioutil.WriteFile(historyArchivePath, content, 0644)
+	err = ioutil.WriteFile(conv.historyArchivePath(index), content, 0644)
 	return index, err
 }
 
-func loadHistoryArchive(index int) (int, error) {
-	basePath := getHistoryFilePath()
-	baseDir, baseName := filepath.Split(basePath)
-	extension := filepath.Ext(baseName)
-	baseName = baseName[:len(baseName)-len(extension)]
-
+func loadHistoryArchive(conv *Conversation, index int) (int, error) {
 	if index <= 0 {
 		lastAvailableIndex := 0
 		for i := 1; i <= 9999; i++ {
-			historyArchivePath := fmt.Sprintf("%s%s.%d%s", baseDir, baseName, i, extension)
-			if _, err := os.Stat(historyArchivePath); err != nil {
+			if _, err := os.Stat(conv.historyArchivePath(i)); err != nil {
 				break
 			}
 			lastAvailableIndex = i
@@ -382,241 +626,734 @@ func loadHistoryArchive(index int) (int, error) {
 		return 0, fmt.Errorf("index out of valid range")
 	}
 
-	historyArchivePath := fmt.Sprintf("%s%s.%d%s", baseDir, baseName, index, extension)
-	content, err := ioutil.ReadFile(historyArchivePath)
+	content, err := ioutil.ReadFile(conv.historyArchivePath(index))
 	if err != nil {
 		return index, err
 	}
-	err = ioutil.WriteFile(basePath, content, 0644)
+	err = ioutil.WriteFile(conv.historyFilePath(), content, 0644)
 	return index, err
 }
 
-func (bot *Bot) callAPI(query string) string {
+// apiError is returned for failures calling the API endpoint. Its message is
+// suitable for sending back to the channel.
+type apiError struct {
+	kind    string
+	message string
+	err     error
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func (bot *Bot) callAPI(ctx context.Context, conv *Conversation, user, query string) string {
 	bot.IsAvailable = false
 	defer func() { bot.IsAvailable = true }()
+	ctx, sources := withDocSources(ctx)
 
 	var responseContent string
-	var payload map[string]interface{}
-
-	// Prepare payload for the API call based on the mode
+	var err error
 
 	// Use "chat" for "/v1/chat/completions" endpoint
 	// Use "query" for "/completion" endpoint
 
 	if *bot.Config.APIMode == "chat" {
-		history := loadMessageHistory()
-		newUserMessage := Message{Role: "user", Content: query}
-		history = append(history, newUserMessage)
-		saveMessageHistory([]Message{newUserMessage})
+		responseContent, err = bot.callChat(ctx, conv, user, query)
+	} else if *bot.Config.APIMode == "query" {
+		responseContent, err = bot.callQuery(ctx, conv, user, query)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	// The response is saved once moderated, so blocked or redacted text is
+	// never sent to the model again with the history.
+	responseContent, _ = bot.moderate(ctx, conv, "output", user, responseContent)
+
+	metrics.ResponseLength.Observe(float64(len(responseContent)), conv.metricLabels()...)
+	if *bot.Config.APIMode == "chat" || conv.Settings.PromptTemplate != "" {
+		if responseContent != "" {
+			saveResponse(conv, responseContent)
+		}
+		recordHistorySize(conv)
+	}
+
+	return sources.cite(responseContent)
+}
+
+func (bot *Bot) callChat(ctx context.Context, conv *Conversation, user, query string) (string, error) {
+	logger := loggerFrom(ctx)
+	newUserMessage := Message{Role: "user", Content: query}
+	saveMessageHistory(conv, []Message{newUserMessage})
+
+	retrieved := bot.contextMessages(ctx, conv, user, query)
+	userIndex := len(loadMessageHistory(conv)) - 1
+	images := bot.findImages(ctx, conv, query)
 
-		messagesPayload := make([]map[string]interface{}, len(history))
+	tools := bot.allowedTools(conv.Target)
+	var responseContent string
+	for iteration := 0; ; iteration++ {
+		history := loadMessageHistory(conv)
+		messages := make([]interface{}, 0, len(history)+len(retrieved))
 		for i, msg := range history {
-			messagesPayload[i] = map[string]interface{}{
-				"role":    msg.Role,
-				"content": msg.Content,
+			msg = bot.apiMessage(msg)
+			if i != userIndex {
+				messages = append(messages, msg)
+				continue
+			}
+			for _, extra := range retrieved {
+				messages = append(messages, extra)
+			}
+			if len(images) > 0 {
+				messages = append(messages, payloadMessage{Message: msg, Content: chatImageContent(msg.Content, images)})
+			} else {
+				messages = append(messages, msg)
 			}
 		}
-
-		payload = map[string]interface{}{
-			"messages": messagesPayload,
+		payload := map[string]interface{}{
+			"messages": messages,
 			"stream":   false,
 		}
-	} else if *bot.Config.APIMode == "query" {
-		payload = map[string]interface{}{
-			"prompt": query,
-			"stream": false,
+		if len(tools) > 0 && iteration < *bot.Config.MaxToolIterations {
+			payload["tools"] = toolDefinitions(tools)
 		}
-	}
+		applyPayloadOptions(payload, conv.Options)
+		applyModel(payload, conv)
 
-	// Include options from the Options struct
-	if bot.Options != nil {
-		val := reflect.ValueOf(*bot.Options)
-		typ := val.Type()
-		for i := 0; i < val.NumField(); i++ {
-			field := val.Field(i)
-			if !field.IsNil() {
-				payloadKey := strings.ToLower(typ.Field(i).Name)
-				payload[payloadKey] = field.Elem().Interface()
+		body, err := bot.postAPI(ctx, conv, payload)
+		if err != nil {
+			return "", err
+		}
+
+		var response struct {
+			Choices []struct {
+				Message Message `json:"message"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			metrics.APIErrors.Inc(conv.metricLabels("decode")...)
+			logger.Error("Error decoding response from API", "error", err)
+			return "", &apiError{kind: "decode", message: "Error parsing response.", err: err}
+		}
+		if len(response.Choices) == 0 {
+			break
+		}
+
+		message := response.Choices[0].Message
+		if len(message.ToolCalls) > 0 && iteration < *bot.Config.MaxToolIterations {
+			// Record the request and every result so the model sees them on
+			// the next iteration, and so they remain in the history.
+			results := []Message{{Role: "assistant", Content: message.Content, ToolCalls: message.ToolCalls}}
+			for _, call := range message.ToolCalls {
+				results = append(results, runToolCall(ctx, conv, tools, call))
 			}
+			saveMessageHistory(conv, results)
+			continue
 		}
+
+		responseContent = message.Content
+		break
 	}
+	return responseContent, nil
+}
 
-	// Serialize the payload to JSON
-	payloadBytes, err := json.Marshal(payload)
+// callQuery sends a single prompt to the "/completion" endpoint. With a
+// prompt template set in profile.json the prompt holds the whole
+// conversation, as in "chat" mode, otherwise only the user's message.
+func (bot *Bot) callQuery(ctx context.Context, conv *Conversation, user, query string) (string, error) {
+	logger := loggerFrom(ctx)
+	tmpl, err := loadPromptTemplate(conv)
 	if err != nil {
-		log.Printf("Error encoding payload to JSON: %v", err)
-		return "Error encoding request payload."
+		logger.Error("Error loading prompt template", "error", err)
+		return "", &apiError{kind: "template", message: "Error loading prompt template.", err: err}
 	}
 
-	// Sending the payload to the API
-	log.Printf("Sending payload: %s\n", string(payloadBytes))
-	req, err := http.NewRequest("POST", *bot.Config.APIURL, bytes.NewBuffer(payloadBytes))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+*bot.Config.APIKey)
+	var imageData []map[string]interface{}
+	var imageRefs string
+	if images := bot.findImages(ctx, conv, query); len(images) > 0 {
+		imageData, imageRefs = queryImageData(images)
+	}
 
-	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		return "Error creating request."
+	extras := bot.contextMessages(ctx, conv, user, query)
+	payload := map[string]interface{}{
+		"stream": false,
+	}
+	if tmpl == nil {
+		prompt := bot.delimitUserContent(query)
+		for i := len(extras) - 1; i >= 0; i-- {
+			prompt = extras[i].Content + "\n" + prompt
+		}
+		payload["prompt"] = imageRefs + prompt
+	} else {
+		saveMessageHistory(conv, []Message{{Role: "user", Content: query}})
+		history := loadMessageHistory(conv)
+		userIndex := len(history) - 1
+		var messages []Message
+		for _, msg := range history[:userIndex] {
+			messages = append(messages, bot.apiMessage(msg))
+		}
+		messages = append(append(messages, extras...), Message{Role: "user", Content: imageRefs + bot.delimitUserContent(query)})
+
+		prompt, err := tmpl.render(messages)
+		if err != nil {
+			logger.Error("Error rendering prompt template", "error", err)
+			return "", &apiError{kind: "template", message: "Error rendering prompt template.", err: err}
+		}
+		payload["prompt"] = prompt
+		payload["stop"] = tmpl.Stop
+	}
+	if imageData != nil {
+		payload["image_data"] = imageData
 	}
+	applyPayloadOptions(payload, conv.Options)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	body, err := bot.postAPI(ctx, conv, payload)
 	if err != nil {
-		log.Printf("Error making request to API: %v", err)
-		return "Error sending request."
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	// Reading the response from the API
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return "Error reading response."
+	// Directly parse the response content for query mode
+	var response struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		metrics.APIErrors.Inc(conv.metricLabels("decode")...)
+		logger.Error("Error decoding response from API", "error", err)
+		return "", &apiError{kind: "decode", message: "Error parsing response.", err: err}
+	}
+	return strings.TrimSpace(response.Content), nil
+}
+
+// contextMessages returns what is remembered about the user and documents
+// relevant to the query. They are sent just before the user's message, but
+// are not kept in the history.
+func (bot *Bot) contextMessages(ctx context.Context, conv *Conversation, user, query string) []Message {
+	var messages []Message
+	if content := memoryContext(ctx, conv, user); content != "" {
+		messages = append(messages, Message{Role: "user", Content: bot.delimitUserContent(content)})
+	}
+	if content := bot.retrieveContext(ctx, conv, query); content != "" {
+		messages = append(messages, Message{Role: "system", Content: content})
+	}
+	return append(messages, bot.guardMessages(ctx)...)
+}
+
+// saveResponse appends the assistant's response to the message history,
+// followed by the reminder prompt if it exists.
+func saveResponse(conv *Conversation, content string) {
+	responseMessage := Message{Role: "assistant", Content: content}
+	saveMessageHistory(conv, []Message{responseMessage})
+
+	reminderPrompt := loadReminderPrompt(conv)
+	if reminderPrompt != "" {
+		reminderMessage := Message{Role: "system", Content: reminderPrompt}
+		saveMessageHistory(conv, []Message{reminderMessage})
 	}
+}
 
-	log.Printf("Received response: %s\n", string(body))
+// complete sends messages to the API endpoint outside of the conversation,
+// without reading or saving the message history. In "query" mode the
+// messages are rendered with the prompt template, or joined if there is none.
+func (bot *Bot) complete(ctx context.Context, conv *Conversation, messages []Message) (string, error) {
+	return bot.completeWith(ctx, conv, messages, conv.Options)
+}
 
-	// Parsing the response
+// completeWith is complete using options instead of the conversation's options.
+func (bot *Bot) completeWith(ctx context.Context, conv *Conversation, messages []Message, options *Options) (string, error) {
 	if *bot.Config.APIMode == "chat" {
+		payload := map[string]interface{}{
+			"messages": messages,
+			"stream":   false,
+		}
+		applyPayloadOptions(payload, options)
+		applyModel(payload, conv)
+		body, err := bot.postAPI(ctx, conv, payload)
+		if err != nil {
+			return "", err
+		}
 		var response struct {
 			Choices []struct {
-				Message struct {
-					Content string `json:"content"`
-				} `json:"message"`
+				Message Message `json:"message"`
 			} `json:"choices"`
 		}
 		if err := json.Unmarshal(body, &response); err != nil {
-			log.Printf("Error decoding response from API: %v", err)
-			return "Error parsing response."
+			return "", err
 		}
+		if len(response.Choices) == 0 {
+			return "", nil
+		}
+		return strings.TrimSpace(response.Choices[0].Message.Content), nil
+	}
 
-		if len(response.Choices) > 0 && response.Choices[0].Message.Content != "" {
-			responseContent = response.Choices[0].Message.Content
-			// Append the assistant's response to the message history
-			responseMessage := Message{Role: "assistant", Content: responseContent}
-			saveMessageHistory([]Message{responseMessage})
-
-			// Append the reminder prompt if it exists
-			reminderPrompt := loadReminderPrompt()
-			if reminderPrompt != "" {
-				reminderMessage := Message{Role: "system", Content: reminderPrompt}
-				saveMessageHistory([]Message{reminderMessage})
-			}
+	payload := map[string]interface{}{
+		"stream": false,
+	}
+	tmpl, err := loadPromptTemplate(conv)
+	if err != nil {
+		return "", err
+	}
+	if tmpl != nil {
+		prompt, err := tmpl.render(messages)
+		if err != nil {
+			return "", err
 		}
-	} else if *bot.Config.APIMode == "query" {
-		// Directly parse the response content for query mode
-		var response struct {
-			Content string `json:"content"`
+		payload["prompt"] = prompt
+		payload["stop"] = tmpl.Stop
+	} else {
+		parts := make([]string, len(messages))
+		for i, msg := range messages {
+			parts[i] = msg.Content
 		}
-		if err := json.Unmarshal(body, &response); err != nil {
-			log.Printf("Error decoding response from API: %v", err)
-			return "Error parsing response."
+		payload["prompt"] = strings.Join(parts, "\n")
+	}
+	applyPayloadOptions(payload, options)
+	body, err := bot.postAPI(ctx, conv, payload)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response.Content), nil
+}
+
+// applyPayloadOptions includes options from the Options struct in the payload.
+func applyPayloadOptions(payload map[string]interface{}, options *Options) {
+	if options == nil {
+		return
+	}
+	val := reflect.ValueOf(*options)
+	typ := val.Type()
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i)
+		if !field.IsNil() {
+			payload[optionName(typ.Field(i))] = field.Elem().Interface()
 		}
-		responseContent = response.Content
 	}
+}
+
+// postAPI sends the payload to the API endpoint and returns the response body.
+func (bot *Bot) postAPI(ctx context.Context, conv *Conversation, payload map[string]interface{}) ([]byte, error) {
+	logger := loggerFrom(ctx)
+
+	// Serialize the payload to JSON
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		metrics.APIErrors.Inc(conv.metricLabels("encode")...)
+		logger.Error("Error encoding payload to JSON", "error", err)
+		return nil, &apiError{kind: "encode", message: "Error encoding request payload.", err: err}
+	}
+
+	// Sending the payload to the API
+	logger.Debug("Sending payload", "api_url", *bot.Config.APIURL, "payload", string(payloadBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", *bot.Config.APIURL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		metrics.APIErrors.Inc(conv.metricLabels("request")...)
+		logger.Error("Error creating request", "error", err)
+		return nil, &apiError{kind: "request", message: "Error creating request.", err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+*bot.Config.APIKey)
+
+	start := time.Now()
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		metrics.APIErrors.Inc(conv.metricLabels("send")...)
+		logger.Error("Error making request to API", "error", err)
+		return nil, &apiError{kind: "send", message: "Error sending request.", err: err}
+	}
+	defer resp.Body.Close()
+
+	// Reading the response from the API
+	body, err := ioutil.ReadAll(resp.Body)
+	metrics.APILatency.Observe(time.Since(start).Seconds(), conv.metricLabels()...)
+	if err != nil {
+		metrics.APIErrors.Inc(conv.metricLabels("read")...)
+		logger.Error("Error reading response body", "error", err)
+		return nil, &apiError{kind: "read", message: "Error reading response.", err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		metrics.APIErrors.Inc(conv.metricLabels("status")...)
+	}
+
+	logger.Debug("Received response", "status", resp.StatusCode, "response", string(body))
+	return body, nil
+}
+
+// knownCommands are the commands handled by handleCommands. Anything else
+// is counted as "unknown", so users cannot add metric series at will.
+var knownCommands = map[string]bool{
+	"!clear": true, "!system": true, "!options": true, "!set": true,
+	"!get": true, "!status": true, "!models": true, "!model": true,
+	"!profile": true, "!profiles": true, "!reindex": true, "!remember": true,
+	"!forget": true, "!memories": true, "!remindme": true, "!block": true,
+	"!unblock": true, "!blocklist": true, "!save": true, "!load": true,
+}
 
-	return responseContent
+// readOnlyCommands only report state, so they are answered even while the
+// bot is busy with a request, which is when "!status" is most useful.
+var readOnlyCommands = map[string]bool{
+	"!status": true, "!get": true, "!models": true, "!profiles": true,
+	"!memories": true, "!blocklist": true,
 }
 
-func handleCommands(bot *Bot, command, query, user string) {
+func handleCommands(ctx context.Context, bot *Bot, conv *Conversation, command, query, user string, admin bool) {
+	if knownCommands[command] {
+		metrics.Commands.Inc(conv.metricLabels(command)...)
+	} else {
+		metrics.Commands.Inc(conv.metricLabels("unknown")...)
+	}
 	switch command {
 	case "!clear":
-		historyFilePath := getHistoryFilePath()
+		historyFilePath := conv.historyFilePath()
 		if _, err := os.Stat(historyFilePath); os.IsNotExist(err) {
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: I can't clear my recent memory. It may already be empty.", user))
+			sendMessage(conv.Target, fmt.Sprintf("%s: I can't clear my recent memory. It may already be empty.", user))
 		} else {
-			createMessageHistory()
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: My recent memory has been cleared.", user))
+			createMessageHistory(conv)
+			recordHistorySize(conv)
+			sendMessage(conv.Target, fmt.Sprintf("%s: My recent memory has been cleared.", user))
 		}
 	case "!system":
-		newSystemMessage := Message{Role: "system", Content: query}
-		saveMessageHistory([]Message{newSystemMessage})
-		sendMessage(bot.Config.Channel, fmt.Sprintf("%s: Specified system prompt will be attached to the next message.", user))
+		if *bot.Config.SystemCommand == "disabled" {
+			sendMessage(conv.Target, fmt.Sprintf("%s: The !system command is disabled.", user))
+			return
+		}
+		if *bot.Config.SystemCommand != "everyone" && !admin {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Only admins can add system prompts.", user))
+			return
+		}
+		operatorMessage := Message{Role: operatorRole, Name: user, Content: query}
+		saveMessageHistory(conv, []Message{operatorMessage})
+		slog.Info("Operator instruction added", "nick", user, "prompt", query)
+		sendMessage(conv.Target, fmt.Sprintf("%s: Specified system prompt will be attached to the next message.", user))
 	case "!options":
-		optionsFile := fmt.Sprintf("options.%s.json", query)
-		newOptions, err := loadOptions(optionsFile)
+		handleOptionsCommand(bot, conv, query, user, admin)
+	case "!set":
+		fields := strings.Fields(query)
+		if len(fields) < 2 {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Usage: !set <option> <value>, e.g. '!set temperature 0.5'. Use 'default' to unset an option.", user))
+			return
+		}
+		// Prompts are instructions to the model, allowed to the same users
+		// as "!system".
+		if promptOption(fields[0]) && (*bot.Config.SystemCommand == "disabled" || *bot.Config.SystemCommand != "everyone" && !admin) {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Only admins can change %s.", user, strings.ToLower(fields[0])))
+			return
+		}
+		newOptions, err := setOption(conv.Options, fields[0], strings.Join(fields[1:], " "))
+		if err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: %s.", user, err))
+			return
+		}
+		newConv := *conv
+		newConv.Options = newOptions
+		if err := bot.setConversation(&newConv); err != nil {
+			slog.Error("Error saving conversation", "target", conv.Target, "error", err)
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error saving option: %s", user, err))
+			return
+		}
+		value, _ := getOption(newOptions, fields[0])
+		slog.Info("Option changed", "target", conv.Target, "option", strings.ToLower(fields[0]), "value", value, "by", user)
+		sendMessage(conv.Target, fmt.Sprintf("%s: %s is now %s.", user, strings.ToLower(fields[0]), value))
+	case "!get":
+		name := strings.TrimSpace(query)
+		if name == "" {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Usage: !get <option>. Options: %s", user, strings.Join(optionNames(), ", ")))
+			return
+		}
+		value, err := getOption(conv.Options, name)
 		if err != nil {
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: Failed to load options from '%s'.", user, optionsFile))
+			sendMessage(conv.Target, fmt.Sprintf("%s: %s.", user, err))
 		} else {
-			bot.Options = newOptions
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: Options loaded successfully from '%s'.", user, optionsFile))
+			sendMessage(conv.Target, fmt.Sprintf("%s: %s is %s.", user, strings.ToLower(name), value))
 		}
+	case "!status":
+		go statusCommand(ctx, bot, conv, user)
+	case "!models":
+		// Listing models waits on the endpoint, which must not hold up the
+		// IRC connection.
+		go listModelsCommand(bot, conv, user)
+	case "!model":
+		go handleModelCommand(bot, conv, query, user)
 	case "!profile":
-		loadProfile(bot, query, user)
+		handleProfileCommand(bot, conv, query, user, admin)
+	case "!profiles":
+		listProfilesCommand(conv, user)
+	case "!reindex":
+		if !admin {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Only admins can rebuild the document index.", user))
+			return
+		}
+		if bot.Config.RAG == nil || bot.Config.RAG.EmbeddingURL == "" {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Document search is not enabled.", user))
+			return
+		}
+		docsDir := conv.docsDir()
+		if _, err := os.Stat(docsDir); err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: The directory does not exist: '%s'.", user, docsDir))
+			return
+		}
+		started := bot.rebuildDocIndex(docsDir, conv.docIndexPath(), func(index *docIndex, err error) {
+			if err != nil {
+				sendMessage(conv.Target, fmt.Sprintf("%s: Error building document index: %s", user, err))
+			} else {
+				sendMessage(conv.Target, fmt.Sprintf("%s: Document index rebuilt with %d excerpts.", user, len(index.Chunks)))
+			}
+		})
+		if !started {
+			sendMessage(conv.Target, fmt.Sprintf("%s: The document index for '%s' is already being built.", user, docsDir))
+			return
+		}
+		sendMessage(conv.Target, fmt.Sprintf("%s: Rebuilding the document index for '%s'.", user, docsDir))
+	case "!remember":
+		fact := strings.TrimSpace(query)
+		if fact == "" {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Tell me what to remember, e.g. '!remember I prefer Python'.", user))
+			return
+		}
+		key := memoryKeyFrom(ctx)
+		if key == "" {
+			sendMessage(conv.Target, fmt.Sprintf("%s: I can't tell who you are, so I can't remember things about you.", user))
+			return
+		}
+		// Facts are sent with every later request, so they are checked
+		// like any other message. Moderation can wait on the endpoint.
+		go func() {
+			fact, stop := bot.screenInput(ctx, conv, user, fact)
+			if stop {
+				sendMessage(conv.Target, fmt.Sprintf("%s: %s", user, fact))
+				return
+			}
+			if fact == "" {
+				return
+			}
+			memory, err := addMemory(conv, key, fact, "user")
+			if err != nil {
+				sendMessage(conv.Target, fmt.Sprintf("%s: Error saving memory: %s", user, err))
+			} else {
+				sendMessage(conv.Target, fmt.Sprintf("%s: I will remember that (#%d).", user, memory.ID))
+			}
+		}()
+	case "!forget":
+		id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(query), "#"))
+		if err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Tell me the number of the memory to forget, as shown by !memories.", user))
+			return
+		}
+		found, err := forgetMemory(conv, memoryKeyFrom(ctx), id)
+		if err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error forgetting memory: %s", user, err))
+		} else if !found {
+			sendMessage(conv.Target, fmt.Sprintf("%s: I don't have a memory #%d about you.", user, id))
+		} else {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Memory #%d has been forgotten.", user, id))
+		}
+	case "!memories":
+		memories, err := userMemories(conv, memoryKeyFrom(ctx))
+		if err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error loading memories: %s", user, err))
+		} else if len(memories) == 0 {
+			sendMessage(conv.Target, fmt.Sprintf("%s: I don't remember anything about you yet.", user))
+		} else {
+			facts := make([]string, len(memories))
+			for i, memory := range memories {
+				facts[i] = fmt.Sprintf("#%d %s", memory.ID, memory.Fact)
+			}
+			sendMessage(conv.Target, fmt.Sprintf("%s: %s", user, strings.Join(facts, " | ")))
+		}
+	case "!remindme":
+		fields := strings.Fields(query)
+		if len(fields) < 2 {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Usage: !remindme <duration> <text>, e.g. '!remindme 2h check the build'.", user))
+			return
+		}
+		duration, err := parseReminderDuration(fields[0])
+		if err != nil || duration <= 0 {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Invalid duration '%s'. Use a duration such as 30m, 2h or 1d12h, of up to a year.", user, fields[0]))
+			return
+		}
+		text := strings.Join(fields[1:], " ")
+		if len(text) > maxReminderText {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Reminders can be at most %d characters long.", user, maxReminderText))
+			return
+		}
+		due := time.Now().Add(duration)
+		reminder := Reminder{User: user, Channel: conv.Target, Due: due, Text: text}
+		if err := addReminder(reminder); err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error saving reminder: %s", user, err))
+		} else {
+			sendMessage(conv.Target, fmt.Sprintf("%s: I will remind you at %s.", user, due.Format("2006-01-02 15:04 MST")))
+		}
+	case "!block":
+		if !admin {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Only admins can block users.", user))
+			return
+		}
+		fields := strings.Fields(query)
+		if len(fields) == 0 {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Usage: !block <nick|nick!user@host|$a:account> [duration] [reason]", user))
+			return
+		}
+		entry := accessEntry{Mask: fields[0]}
+		rest := fields[1:]
+		if len(rest) > 0 {
+			if duration, err := parseReminderDuration(rest[0]); err == nil && duration > 0 {
+				entry.Expires = time.Now().Add(duration).Truncate(time.Second)
+				rest = rest[1:]
+			}
+		}
+		entry.Reason = strings.Join(rest, " ")
+		if err := addBlock(conv.Profile, entry); err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error saving block list: %s", user, err))
+		} else if entry.Expires.IsZero() {
+			slog.Info("Blocked user", "mask", entry.Mask, "by", user, "reason", entry.Reason)
+			sendMessage(conv.Target, fmt.Sprintf("%s: Blocked '%s'.", user, entry.Mask))
+		} else {
+			slog.Info("Blocked user", "mask", entry.Mask, "by", user, "reason", entry.Reason, "expires", entry.Expires)
+			sendMessage(conv.Target, fmt.Sprintf("%s: Blocked '%s' until %s.", user, entry.Mask, entry.Expires.Format("2006-01-02 15:04 MST")))
+		}
+	case "!unblock":
+		if !admin {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Only admins can unblock users.", user))
+			return
+		}
+		mask := strings.TrimSpace(query)
+		found, err := removeBlock(conv.Profile, mask)
+		if err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error saving block list: %s", user, err))
+		} else if !found {
+			sendMessage(conv.Target, fmt.Sprintf("%s: '%s' is not on the block list.", user, mask))
+		} else {
+			slog.Info("Unblocked user", "mask", mask, "by", user)
+			sendMessage(conv.Target, fmt.Sprintf("%s: Unblocked '%s'.", user, mask))
+		}
+	case "!blocklist":
+		if !admin {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Only admins can view the block list.", user))
+			return
+		}
+		entries := activeBlocks(conv.Profile)
+		if len(entries) == 0 {
+			sendMessage(conv.Target, fmt.Sprintf("%s: The block list is empty.", user))
+			return
+		}
+		blocks := make([]string, len(entries))
+		for i, entry := range entries {
+			blocks[i] = entry.Mask
+			if !entry.Expires.IsZero() {
+				blocks[i] += fmt.Sprintf(" (until %s)", entry.Expires.Format("2006-01-02 15:04 MST"))
+			}
+			if entry.Reason != "" {
+				blocks[i] += ": " + entry.Reason
+			}
+		}
+		sendMessage(conv.Target, fmt.Sprintf("%s: %s", user, strings.Join(blocks, " | ")))
 	case "!save":
 		index, err := strconv.Atoi(query)
 		if err != nil {
 			index = 0
 		}
-		idxUsed, err := saveHistoryArchive(index)
+		idxUsed, err := saveHistoryArchive(conv, index)
 		if err != nil {
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: Error saving history: %s", user, err))
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error saving history: %s", user, err))
 		} else {
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: History successfully saved as history.%d.txt", user, idxUsed))
+			sendMessage(conv.Target, fmt.Sprintf("%s: History successfully saved as %s", user, filepath.Base(conv.historyArchivePath(idxUsed))))
 		}
 	case "!load":
 		index, err := strconv.Atoi(query)
 		if err != nil {
 			index = 0
 		}
-		idxUsed, err := loadHistoryArchive(index)
+		idxUsed, err := loadHistoryArchive(conv, index)
 		if err != nil {
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: Error loading history: %s", user, err))
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error loading history: %s", user, err))
 		} else {
-			sendMessage(bot.Config.Channel, fmt.Sprintf("%s: History successfully loaded from history.%d.txt", user, idxUsed))
+			recordHistorySize(conv)
+			sendMessage(conv.Target, fmt.Sprintf("%s: History successfully loaded from %s", user, filepath.Base(conv.historyArchivePath(idxUsed))))
 		}
 	}
 }
 
-func splitMessage(response string, maxSize int) []string {
-	var parts []string
-	var currentSize int
-	var currentPart bytes.Buffer
+func main() {
+	flags, err := parseFlags(os.Args[1:])
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	if err := applyFlags(flags); err != nil {
+		fatal("Invalid command-line flags", "error", err)
+	}
 
-	// Regular expression to collapse multiple newlines
-	re := regexp.MustCompile(`\n+`)
-	normalizedResponse := re.ReplaceAllString(response, "\n")
+	config := loadConfig()
+	if flags.LogLevel != "" {
+		config.LogLevel = &flags.LogLevel
+	}
+	if flags.Validate {
+		// Validation only reads files, so it logs to the terminal.
+		noLogFile := ""
+		config.LogFile = &noLogFile
+	}
+	if err := setupLogging(config); err != nil {
+		fatal("Error configuring logging", "error", err)
+	}
 
-	for _, runeValue := range normalizedResponse {
-		if currentSize+len(string(runeValue)) > maxSize || runeValue == '\n' {
-			if currentPart.Len() > 0 {
-				parts = append(parts, currentPart.String())
-				currentPart.Reset()
-				currentSize = 0
-			}
-			// Skip directly appending newline to avoid empty strings
-			if runeValue != '\n' {
-				currentPart.WriteRune(runeValue)
-				currentSize += len(string(runeValue))
-			}
-		} else {
-			currentPart.WriteRune(runeValue)
-			currentSize += len(string(runeValue))
+	bot := NewBot(config)
+	conv := bot.conversation(config.Channel)
+	if flags.Validate {
+		if err := validateConfig(bot, conv); err != nil {
+			fatal("Invalid configuration", "error", err)
 		}
+		fmt.Println("Configuration is valid.")
+		return
+	}
+	if conv.Options == nil {
+		slog.Info("No default options loaded", "profile", conv.profileLabel())
+	} else {
+		slog.Info("Default options loaded successfully.", "profile", conv.profileLabel())
 	}
 
-	if currentPart.Len() > 0 {
-		parts = append(parts, currentPart.String())
+	if config.RAG != nil && config.RAG.EmbeddingURL != "" {
+		// Start building the document index now, not on the first question.
+		bot.loadDocIndex(context.Background(), conv.docsDir(), conv.docIndexPath())
 	}
 
-	return parts
-}
+	if *config.MetricsAddr != "" {
+		startMetricsServer(*config.MetricsAddr)
+	}
 
-func main() {
-	loadBlockedUsers()
-	config := loadConfig()
+	if config.Backend != nil {
+		supervisor, err := NewSupervisor(config.Backend, *config.APIURL)
+		if err != nil {
+			fatal("Invalid backend settings in config.json", "error", err)
+		}
+		bot.backend = supervisor
+		supervisor.Start()
+
+		// Stop the backend with Nisaba, rather than leaving it running.
+		atExit(supervisor.Stop)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			slog.Info("Shutting down", "signal", sig.String())
+			runExitFuncs()
+			os.Exit(0)
+		}()
+	}
 
-	defaultOptions, err := loadOptions("options.json")
+	health, err := NewHealthMonitor(bot)
 	if err != nil {
-		log.Printf("No default options loaded: %v", err)
-	} else {
-		log.Println("Default options loaded successfully.")
+		fatal("Invalid health check settings in config.json", "error", err)
 	}
-
-	bot := NewBot(config)
-	bot.Options = defaultOptions
+	bot.health = health
 
 	ircBot := NewIRCBot(bot)
 	sendMessage = ircBot.sendIRCMessage
 	ircBot.ConnectAndListen()
+	runExitFuncs()
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// optionRanges are the valid values of numeric options, checked by "!set".
+var optionRanges = map[string][2]float64{
+	"temperature":       {0, 5},
+	"top_k":             {0, 1000},
+	"top_p":             {0, 1},
+	"min_p":             {0, 1},
+	"n_predict":         {-1, 1000000},
+	"n_keep":            {-1, 1000000},
+	"tfs_z":             {0, 1},
+	"typical_p":         {0, 1},
+	"repeat_penalty":    {0, 10},
+	"repeat_last_n":     {-1, 1000000},
+	"presence_penalty":  {-2, 2},
+	"frequency_penalty": {-2, 2},
+	"mirostat":          {0, 2},
+	"mirostat_tau":      {0, 100},
+	"mirostat_eta":      {0, 1},
+	"seed":              {-1, math.MaxInt32},
+	"n_probs":           {0, 100},
+	"slot_id":           {-1, 1000},
+}
+
+// optionName returns the name of an Options field as it appears in
+// "options.json" and in the payload sent to the API endpoint.
+func optionName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return name
+}
+
+// optionField returns the field of options with the given name.
+func optionField(options *Options, name string) (reflect.Value, bool) {
+	val := reflect.ValueOf(options).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		if optionName(typ.Field(i)) == name {
+			return val.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// promptOption reports whether an option holds text sent to the model, such
+// as "system_prompt", which "!set" treats like "!system".
+func promptOption(name string) bool {
+	field, ok := optionField(&Options{}, strings.ToLower(name))
+	return ok && field.Type().Elem().Kind() == reflect.String
+}
+
+func optionNames() []string {
+	typ := reflect.TypeOf(Options{})
+	names := make([]string, typ.NumField())
+	for i := range names {
+		names[i] = optionName(typ.Field(i))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getOption returns the value of an option, or "default" if it is not set
+// and the API endpoint's default is used.
+func getOption(options *Options, name string) (string, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	field, ok := optionField(options, strings.ToLower(name))
+	if !ok {
+		return "", fmt.Errorf("unknown option '%s'", name)
+	}
+	if field.IsNil() {
+		return "default", nil
+	}
+	return fmt.Sprint(field.Elem().Interface()), nil
+}
+
+// setOption returns a copy of options with one option changed. The value
+// "default" unsets the option, so the API endpoint's default is used.
+func setOption(options *Options, name, value string) (*Options, error) {
+	updated := Options{}
+	if options != nil {
+		updated = *options
+	}
+	name = strings.ToLower(name)
+	field, ok := optionField(&updated, name)
+	if !ok {
+		return nil, fmt.Errorf("unknown option '%s'", name)
+	}
+	if strings.EqualFold(value, "default") {
+		field.Set(reflect.Zero(field.Type()))
+		return &updated, nil
+	}
+
+	parsed := reflect.New(field.Type().Elem())
+	switch field.Type().Elem().Kind() {
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%s must be a number", name)
+		}
+		if err := checkOptionRange(name, f); err != nil {
+			return nil, err
+		}
+		parsed.Elem().SetFloat(f)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a whole number", name)
+		}
+		if err := checkOptionRange(name, float64(n)); err != nil {
+			return nil, err
+		}
+		parsed.Elem().SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false", name)
+		}
+		parsed.Elem().SetBool(b)
+	case reflect.String:
+		parsed.Elem().SetString(value)
+	}
+	field.Set(parsed)
+	return &updated, nil
+}
+
+func checkOptionRange(name string, value float64) error {
+	if r, ok := optionRanges[name]; ok && (value < r[0] || value > r[1]) {
+		return fmt.Errorf("%s must be between %s and %s", name,
+			strconv.FormatFloat(r[0], 'g', -1, 64), strconv.FormatFloat(r[1], 'g', -1, 64))
+	}
+	return nil
+}
+
+// formatOptions lists the options that are set, in a single line.
+func formatOptions(options *Options) string {
+	if options == nil {
+		return ""
+	}
+	var set []string
+	for _, name := range optionNames() {
+		if value, _ := getOption(options, name); value != "default" {
+			set = append(set, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	return strings.Join(set, ", ")
+}
+
+// saveOptions writes options to a file in the conversation's profile.
+func saveOptions(conv *Conversation, fileName string, options *Options) error {
+	if options == nil {
+		options = &Options{}
+	}
+	content, err := json.MarshalIndent(options, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(conv.dataFilePath(fileName), append(content, '\n'), 0644)
+}
+
+// handleOptionsCommand runs "!options", which loads a preset, or its
+// subcommands to show, reset and save the options of the conversation.
+// Saving files is limited to admins.
+func handleOptionsCommand(bot *Bot, conv *Conversation, query, user string, admin bool) {
+	fields := strings.Fields(query)
+	subcommand := ""
+	if len(fields) > 0 {
+		subcommand = strings.ToLower(fields[0])
+	}
+	switch subcommand {
+	case "", "show":
+		current := formatOptions(conv.Options)
+		if current == "" {
+			current = "none set, the API endpoint's defaults are used"
+		}
+		sendMessage(conv.Target, fmt.Sprintf("%s: Options: %s", user, current))
+	case "reset":
+		options, err := loadOptions(conv, "options.json")
+		if err != nil && !os.IsNotExist(err) {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Failed to load options from 'options.json'.", user))
+			return
+		}
+		newConv := *conv
+		newConv.Options = options
+		if err := bot.setConversation(&newConv); err != nil {
+			slog.Error("Error saving conversation", "target", conv.Target, "error", err)
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error saving options: %s", user, err))
+			return
+		}
+		sendMessage(conv.Target, fmt.Sprintf("%s: Options have been reset to the profile's 'options.json'.", user))
+	case "save":
+		if !admin {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Only admins can save options.", user))
+			return
+		}
+		fileName := "options.json"
+		if len(fields) > 1 {
+			if !profileNameRegexp.MatchString(fields[1]) {
+				sendMessage(conv.Target, fmt.Sprintf("%s: Invalid preset name. Only alphanumeric characters are allowed.", user))
+				return
+			}
+			fileName = fmt.Sprintf("options.%s.json", fields[1])
+		}
+		if err := saveOptions(conv, fileName, conv.Options); err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error saving options: %s", user, err))
+			return
+		}
+		sendMessage(conv.Target, fmt.Sprintf("%s: Options saved to '%s'.", user, fileName))
+	default:
+		optionsFile := fmt.Sprintf("options.%s.json", query)
+		newOptions, err := loadOptions(conv, optionsFile)
+		if err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Failed to load options from '%s'.", user, optionsFile))
+		} else {
+			newConv := *conv
+			newConv.Options = newOptions
+			if err := bot.setConversation(&newConv); err != nil {
+				slog.Error("Error saving conversation", "target", conv.Target, "error", err)
+				sendMessage(conv.Target, fmt.Sprintf("%s: Error saving options: %s", user, err))
+				return
+			}
+			sendMessage(conv.Target, fmt.Sprintf("%s: Options loaded successfully from '%s'.", user, optionsFile))
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PasteConfig controls uploading long responses to a paste service instead
+// of sending them to the channel line by line.
+type PasteConfig struct {
+	// Mode is "local" to serve pastes from Nisaba's own HTTP server, or
+	// "http" to upload them to a paste API.
+	Mode         string `json:"mode"`
+	MaxLines     int    `json:"max_lines"`
+	MaxBytes     int    `json:"max_bytes"`
+	PreviewLines int    `json:"preview_lines"`
+
+	// Options for "local" mode.
+	ListenAddress string `json:"listen_address"`
+	PublicURL     string `json:"public_url"`
+	Directory     string `json:"directory"`
+	// MaxAge is how many hours pastes are kept, and MaxPastes how many.
+	MaxAge    int `json:"max_age"`
+	MaxPastes int `json:"max_pastes"`
+
+	// Options for "http" mode.
+	APIURL        string `json:"api_url"`
+	FormField     string `json:"form_field"`
+	ResponseField string `json:"response_field"`
+	URLPrefix     string `json:"url_prefix"`
+}
+
+type Paster interface {
+	Paste(content string) (string, error)
+}
+
+func NewPaster(config *PasteConfig) (Paster, error) {
+	switch config.Mode {
+	case "local":
+		return newLocalPaster(config)
+	case "http":
+		if config.APIURL == "" {
+			return nil, fmt.Errorf("paste mode 'http' requires 'api_url'")
+		}
+		return &httpPaster{config: config, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown paste mode '%s'", config.Mode)
+	}
+}
+
+// pasteNameRegexp matches the random file names given to pastes. Nothing
+// else is served, so the pastes cannot be listed.
+var pasteNameRegexp = regexp.MustCompile(`^[0-9a-f]{16}\.txt$`)
+
+type localPaster struct {
+	dir       string
+	publicURL string
+	maxAge    time.Duration
+	maxPastes int
+}
+
+func newLocalPaster(config *PasteConfig) (*localPaster, error) {
+	if config.ListenAddress == "" || config.PublicURL == "" {
+		return nil, fmt.Errorf("paste mode 'local' requires 'listen_address' and 'public_url'")
+	}
+	dir := config.Directory
+	if dir == "" {
+		dir = "pastes"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/paste/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/paste/")
+		if !pasteNameRegexp.MatchString(name) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeFile(w, r, filepath.Join(dir, name))
+	})
+	go func() {
+		slog.Info("Serving pastes", "address", config.ListenAddress, "directory", dir)
+		if err := http.ListenAndServe(config.ListenAddress, mux); err != nil {
+			slog.Error("Paste server stopped", "error", err)
+		}
+	}()
+
+	p := &localPaster{
+		dir:       dir,
+		publicURL: strings.TrimRight(config.PublicURL, "/"),
+		maxAge:    time.Duration(config.MaxAge) * time.Hour,
+		maxPastes: config.MaxPastes,
+	}
+	go func() {
+		for ; ; time.Sleep(time.Hour) {
+			p.prune()
+		}
+	}()
+	return p, nil
+}
+
+// prune removes pastes older than "max_age", then the oldest pastes beyond
+// "max_pastes", so the directory does not grow without bound.
+func (p *localPaster) prune() {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		slog.Error("Error listing pastes", "directory", p.dir, "error", err)
+		return
+	}
+	type paste struct {
+		path    string
+		modTime time.Time
+	}
+	var pastes []paste
+	for _, entry := range entries {
+		if !pasteNameRegexp.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		pastes = append(pastes, paste{filepath.Join(p.dir, entry.Name()), info.ModTime()})
+	}
+	sort.Slice(pastes, func(i, j int) bool { return pastes[i].modTime.After(pastes[j].modTime) })
+	for i, old := range pastes {
+		if i >= p.maxPastes || time.Since(old.modTime) > p.maxAge {
+			if err := os.Remove(old.path); err != nil && !os.IsNotExist(err) {
+				slog.Warn("Error removing paste", "path", old.path, "error", err)
+			}
+		}
+	}
+}
+
+func (p *localPaster) Paste(content string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(b) + ".txt"
+	if err := os.WriteFile(filepath.Join(p.dir, name), []byte(content), 0644); err != nil {
+		return "", err
+	}
+	p.prune()
+	return fmt.Sprintf("%s/paste/%s", p.publicURL, name), nil
+}
+
+// httpPaster uploads to a generic paste API. The content is sent as the raw
+// request body, or as a multipart form field if FormField is set. The link is
+// read from the response body, or from ResponseField if it is JSON.
+type httpPaster struct {
+	config *PasteConfig
+	client *http.Client
+}
+
+func (p *httpPaster) Paste(content string) (string, error) {
+	var body bytes.Buffer
+	contentType := "text/plain; charset=utf-8"
+	if p.config.FormField != "" {
+		writer := multipart.NewWriter(&body)
+		part, err := writer.CreateFormFile(p.config.FormField, "response.txt")
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.WriteString(part, content); err != nil {
+			return "", err
+		}
+		if err := writer.Close(); err != nil {
+			return "", err
+		}
+		contentType = writer.FormDataContentType()
+	} else {
+		body.WriteString(content)
+	}
+
+	resp, err := p.client.Post(p.config.APIURL, contentType, &body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("paste service returned %s", resp.Status)
+	}
+
+	link := strings.TrimSpace(string(respBody))
+	if p.config.ResponseField != "" {
+		var response map[string]interface{}
+		if err := json.Unmarshal(respBody, &response); err != nil {
+			return "", err
+		}
+		value, ok := response[p.config.ResponseField].(string)
+		if !ok {
+			return "", fmt.Errorf("paste service response has no '%s' field", p.config.ResponseField)
+		}
+		link = value
+	}
+	if link == "" {
+		return "", fmt.Errorf("paste service returned an empty response")
+	}
+	return p.config.URLPrefix + link, nil
+}
+
+// shouldPaste reports whether a response split into lines is long enough to
+// be uploaded to the paste service.
+func shouldPaste(config *PasteConfig, response string, lines []string) bool {
+	if config == nil {
+		return false
+	}
+	return (config.MaxLines > 0 && len(lines) > config.MaxLines) ||
+		(config.MaxBytes > 0 && len(response) > config.MaxBytes)
+}
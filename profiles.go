@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var profileNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// profileSubcommands cannot be used as profile names, as "!profile <name>"
+// would run the subcommand instead of switching profile.
+var profileSubcommands = map[string]bool{"info": true, "create": true, "delete": true, "prompt": true}
+
+// profileConfigFiles are the settings copied by "!profile create". History,
+// memories and the document index belong to a profile and are not copied.
+var profileConfigFiles = []string{
+	"options.json",
+	"profile.json",
+	"systemprompt.txt",
+	"reminderprompt.txt",
+	"prompttemplate.txt",
+	"moderationprompt.txt",
+	"blocklist.txt",
+	"allowlist.txt",
+	"triggers.json",
+	"schedule.json",
+}
+
+func validateProfileName(name string) error {
+	if !profileNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid profile name '%s', only alphanumeric characters are allowed", name)
+	}
+	if profileSubcommands[strings.ToLower(name)] || strings.EqualFold(name, "default") {
+		return fmt.Errorf("'%s' is reserved and cannot be used as a profile name", name)
+	}
+	return nil
+}
+
+func listProfiles() ([]string, error) {
+	entries, err := os.ReadDir("profiles")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && profileNameRegexp.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// createProfile creates a profile directory with the settings of base, or
+// of the conversation's profile and options if base is empty. The base
+// "default" is the config directory. The files are copied to a temporary
+// directory that is renamed once complete, so a failed copy leaves nothing
+// behind.
+func createProfile(conv *Conversation, name, base string) error {
+	if err := validateProfileName(name); err != nil {
+		return err
+	}
+	dirPath := filepath.Join("profiles", name)
+	if _, err := os.Stat(dirPath); err == nil {
+		return fmt.Errorf("profile '%s' already exists", name)
+	}
+
+	source := conv.Profile
+	if base != "" {
+		source = base
+		if strings.EqualFold(base, "default") {
+			source = ""
+		} else if !profileNameRegexp.MatchString(base) {
+			return fmt.Errorf("invalid profile name '%s'", base)
+		} else if _, err := os.Stat(filepath.Join("profiles", base)); err != nil {
+			return fmt.Errorf("profile '%s' does not exist", base)
+		}
+	}
+
+	if err := os.MkdirAll("profiles", 0755); err != nil {
+		return err
+	}
+	tempDir, err := os.MkdirTemp("profiles", "."+name+"-")
+	if err != nil {
+		return err
+	}
+	if err := copyProfileFiles(conv, tempDir, source, base == ""); err != nil {
+		os.RemoveAll(tempDir)
+		return err
+	}
+	if err := os.Chmod(tempDir, 0755); err != nil {
+		os.RemoveAll(tempDir)
+		return err
+	}
+	if err := os.Rename(tempDir, dirPath); err != nil {
+		os.RemoveAll(tempDir)
+		return err
+	}
+	return nil
+}
+
+// copyProfileFiles copies the settings of the source profile to dirPath,
+// with the conversation's options if withOptions is set.
+func copyProfileFiles(conv *Conversation, dirPath, source string, withOptions bool) error {
+	for _, fileName := range profileConfigFiles {
+		content, err := os.ReadFile(getProfileConfigFilePath(source, fileName))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dirPath, fileName), content, 0644); err != nil {
+			return err
+		}
+	}
+
+	// Options loaded with "!options" are part of the current settings.
+	if withOptions && conv.Options != nil {
+		content, err := json.MarshalIndent(conv.Options, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dirPath, "options.json"), content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteProfile(bot *Bot, name string) error {
+	if !profileNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid profile name '%s'", name)
+	}
+	if name == defaultProfile {
+		return fmt.Errorf("profile '%s' is the default set with --profile and cannot be deleted", name)
+	}
+	if bot.profileInUse(name) {
+		return fmt.Errorf("profile '%s' is in use, switch to another profile first", name)
+	}
+	dirPath := filepath.Join("profiles", name)
+	if info, err := os.Stat(dirPath); err != nil || !info.IsDir() {
+		return fmt.Errorf("profile '%s' does not exist", name)
+	}
+	if err := os.RemoveAll(dirPath); err != nil {
+		return err
+	}
+	// Files written at runtime, and settings saved by commands, are kept
+	// separately with "--data-dir".
+	if dataDir != "" {
+		return os.RemoveAll(getProfileDataDir(name))
+	}
+	return nil
+}
+
+func listProfilesCommand(conv *Conversation, user string) {
+	names, err := listProfiles()
+	if err != nil {
+		sendMessage(conv.Target, fmt.Sprintf("%s: Error listing profiles: %s", user, err))
+		return
+	}
+	for i, name := range names {
+		if name == conv.Profile {
+			names[i] = name + " (active)"
+		}
+	}
+	if conv.Profile == "" {
+		names = append([]string{"default (active)"}, names...)
+	} else {
+		names = append([]string{"default"}, names...)
+	}
+	sendMessage(conv.Target, fmt.Sprintf("%s: Profiles: %s", user, strings.Join(names, ", ")))
+}
+
+// profileHasFile reports whether the profile has its own copy of a file,
+// in its directory or saved to the data directory, rather than using the
+// default configuration's.
+func profileHasFile(profile, fileName string) bool {
+	path := getProfileConfigFilePath(profile, fileName)
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	return path == filepath.Join(getProfileDir(profile), fileName) ||
+		(dataDir != "" && path == filepath.Join(getProfileDataDir(profile), fileName))
+}
+
+// profileInfo describes the conversation's profile in a single line.
+func profileInfo(conv *Conversation) string {
+	dirPath := conv.profileDir()
+	var files []string
+	for _, fileName := range profileConfigFiles {
+		if profileHasFile(conv.Profile, fileName) {
+			files = append(files, fileName)
+		}
+	}
+	if len(files) == 0 {
+		files = []string{"none"}
+	}
+	template := conv.Settings.PromptTemplate
+	if template == "" {
+		template = "none"
+	}
+	prompt := strings.Join(strings.Fields(loadSystemPrompt(conv)), " ")
+	if prompt == "" {
+		prompt = "none"
+	} else if len(prompt) > 150 {
+		prompt = truncateUTF8(prompt, 150) + "..."
+	}
+	return fmt.Sprintf("Profile '%s' (%s), files: %s, prompt template: %s, history: %d messages, system prompt: %s",
+		conv.profileLabel(), dirPath, strings.Join(files, ", "), template, len(loadMessageHistory(conv)), prompt)
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// handleProfileCommand runs "!profile" and its subcommands. Switching and
+// viewing profiles is open to everyone, changing them is limited to admins.
+// Switching only changes the profile of the current channel or direct
+// message.
+func handleProfileCommand(bot *Bot, conv *Conversation, query, user string, admin bool) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 || !profileSubcommands[strings.ToLower(fields[0])] {
+		if strings.EqualFold(query, "default") {
+			query = ""
+		}
+		loadProfile(bot, conv, strings.TrimSpace(query), user)
+		return
+	}
+
+	subcommand := strings.ToLower(fields[0])
+	args := fields[1:]
+	if subcommand == "info" {
+		sendMessage(conv.Target, fmt.Sprintf("%s: %s", user, profileInfo(conv)))
+		return
+	}
+	if subcommand == "prompt" && len(args) == 0 {
+		prompt := strings.Join(strings.Fields(loadSystemPrompt(conv)), " ")
+		if prompt == "" {
+			prompt = "There is no system prompt for this profile."
+		}
+		sendMessage(conv.Target, fmt.Sprintf("%s: %s", user, prompt))
+		return
+	}
+	if !admin {
+		sendMessage(conv.Target, fmt.Sprintf("%s: Only admins can change profiles.", user))
+		return
+	}
+
+	switch subcommand {
+	case "create":
+		if len(args) != 1 && !(len(args) == 3 && strings.EqualFold(args[1], "from")) {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Usage: !profile create <name> [from <profile>]", user))
+			return
+		}
+		base := ""
+		if len(args) == 3 {
+			base = args[2]
+		}
+		if err := createProfile(conv, args[0], base); err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error creating profile: %s", user, err))
+			return
+		}
+		slog.Info("Profile created", "profile", args[0], "base", base, "by", user)
+		sendMessage(conv.Target, fmt.Sprintf("%s: Profile '%s' has been created. Use '!profile %s' to switch to it.", user, args[0], args[0]))
+	case "delete":
+		if len(args) != 1 {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Usage: !profile delete <name>", user))
+			return
+		}
+		if err := deleteProfile(bot, args[0]); err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error deleting profile: %s", user, err))
+			return
+		}
+		slog.Info("Profile deleted", "profile", args[0], "by", user)
+		sendMessage(conv.Target, fmt.Sprintf("%s: Profile '%s' has been deleted.", user, args[0]))
+	case "prompt":
+		prompt := strings.TrimSpace(query[len(fields[0]):])
+		if err := os.WriteFile(conv.dataFilePath("systemprompt.txt"), []byte(prompt+"\n"), 0644); err != nil {
+			sendMessage(conv.Target, fmt.Sprintf("%s: Error saving system prompt: %s", user, err))
+			return
+		}
+		slog.Info("System prompt changed", "profile", conv.profileLabel(), "by", user, "prompt", prompt)
+		sendMessage(conv.Target, fmt.Sprintf("%s: The system prompt for profile '%s' has been saved. It is used from the next '!clear'.", user, conv.profileLabel()))
+	}
+}
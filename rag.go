@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RAGConfig enables answering from documents in the "docs" folder of the
+// active profile, or of the config directory for the default profile.
+type RAGConfig struct {
+	// EmbeddingURL is either a llama.cpp "/embedding" endpoint or an
+	// OpenAI-compatible "/v1/embeddings" endpoint.
+	EmbeddingURL string  `json:"embedding_url"`
+	TopK         int     `json:"top_k"`
+	ChunkSize    int     `json:"chunk_size"`
+	ChunkOverlap int     `json:"chunk_overlap"`
+	MinScore     float64 `json:"min_score"`
+}
+
+type docChunk struct {
+	Source    string    `json:"source"`
+	Text      string    `json:"text"`
+	Embedding []float64 `json:"embedding"`
+}
+
+type docIndex struct {
+	Created time.Time  `json:"created"`
+	Chunks  []docChunk `json:"chunks"`
+}
+
+var (
+	docIndexMu       sync.Mutex
+	docIndexCache    = make(map[string]*docIndex)
+	docIndexBuilding = make(map[string]bool)
+)
+
+var docExtensions = map[string]bool{".txt": true, ".md": true, ".markdown": true, ".rst": true}
+
+func (conv *Conversation) docsDir() string {
+	return filepath.Join(conv.profileDir(), "docs")
+}
+
+// docIndexPath is where the index of the profile's documents is saved. It
+// is written at runtime, so it is kept with the history rather than in the
+// docs folder.
+func (conv *Conversation) docIndexPath() string {
+	return conv.dataFilePath("docs.index.json")
+}
+
+// embeddingClient calls the embedding endpoint, which is used while
+// answering messages, so a request that hangs must not hold them up.
+var embeddingClient = &http.Client{Timeout: 60 * time.Second}
+
+func (bot *Bot) embed(ctx context.Context, text string) ([]float64, error) {
+	url := bot.Config.RAG.EmbeddingURL
+	openAI := strings.HasSuffix(strings.TrimRight(url, "/"), "/embeddings")
+
+	var payload map[string]interface{}
+	if openAI {
+		payload = map[string]interface{}{"input": text}
+	} else {
+		payload = map[string]interface{}{"content": text}
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+*bot.Config.APIKey)
+
+	resp, err := embeddingClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embedding endpoint returned %s", resp.Status)
+	}
+
+	var response struct {
+		Embedding json.RawMessage `json:"embedding"`
+		Data      []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	if openAI {
+		if len(response.Data) == 0 {
+			return nil, fmt.Errorf("embedding endpoint returned no data")
+		}
+		return response.Data[0].Embedding, nil
+	}
+
+	// Newer llama.cpp servers return one embedding per token as a nested
+	// array, older ones a single pooled vector.
+	var embedding []float64
+	if err := json.Unmarshal(response.Embedding, &embedding); err == nil {
+		return embedding, nil
+	}
+	var nested [][]float64
+	if err := json.Unmarshal(response.Embedding, &nested); err != nil || len(nested) == 0 {
+		return nil, fmt.Errorf("embedding endpoint returned no embedding")
+	}
+	return nested[0], nil
+}
+
+// chunkDocument splits text into chunks of at most size bytes, breaking at
+// paragraphs where possible, with up to overlap bytes repeated between
+// chunks. The overlap is shortened when it would not fit with what follows.
+func chunkDocument(text string, size, overlap int) []string {
+	var chunks []string
+	var current strings.Builder
+	for _, paragraph := range paragraphRegexp.Split(strings.ReplaceAll(text, "\r\n", "\n"), -1) {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		for _, part := range splitLine(paragraph, size) {
+			if current.Len() > 0 && current.Len()+len(part)+2 > size {
+				chunk := current.String()
+				chunks = append(chunks, chunk)
+				current.Reset()
+				current.WriteString(overlapTail(chunk, min(overlap, size-len(part)-2)))
+			}
+			if current.Len() > 0 {
+				current.WriteString("\n\n")
+			}
+			current.WriteString(part)
+		}
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
+
+// overlapTail returns at most n bytes from the end of chunk, starting at a
+// word so it never splits a character.
+func overlapTail(chunk string, n int) string {
+	if n <= 0 || n >= len(chunk) {
+		return ""
+	}
+	tail := chunk[len(chunk)-n:]
+	if c := chunk[len(chunk)-n-1]; c == ' ' || c == '\n' {
+		return strings.TrimLeft(tail, " \n")
+	}
+	i := strings.IndexAny(tail, " \n")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimLeft(tail[i+1:], " \n")
+}
+
+// buildDocIndex embeds every document in docsDir and saves the index to
+// indexPath.
+func (bot *Bot) buildDocIndex(ctx context.Context, docsDir, indexPath string) (*docIndex, error) {
+	index := &docIndex{Created: time.Now()}
+	err := filepath.WalkDir(docsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !docExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		source, _ := filepath.Rel(docsDir, path)
+		for _, text := range chunkDocument(string(content), bot.Config.RAG.ChunkSize, bot.Config.RAG.ChunkOverlap) {
+			embedding, err := bot.embed(ctx, text)
+			if err != nil {
+				return fmt.Errorf("embedding %s: %w", source, err)
+			}
+			index.Chunks = append(index.Chunks, docChunk{Source: filepath.ToSlash(source), Text: text, Embedding: embedding})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(indexPath, content, 0644); err != nil {
+		return nil, err
+	}
+
+	docIndexMu.Lock()
+	docIndexCache[docsDir] = index
+	docIndexMu.Unlock()
+	return index, nil
+}
+
+// rebuildDocIndex builds the index for docsDir in the background, calling
+// done with the result if it is set. It reports false, without building,
+// if a build of docsDir is already running.
+func (bot *Bot) rebuildDocIndex(docsDir, indexPath string, done func(*docIndex, error)) bool {
+	docIndexMu.Lock()
+	if docIndexBuilding[docsDir] {
+		docIndexMu.Unlock()
+		return false
+	}
+	docIndexBuilding[docsDir] = true
+	docIndexMu.Unlock()
+
+	go func() {
+		slog.Info("Building document index", "directory", docsDir)
+		index, err := bot.buildDocIndex(context.Background(), docsDir, indexPath)
+		docIndexMu.Lock()
+		delete(docIndexBuilding, docsDir)
+		docIndexMu.Unlock()
+		if err != nil {
+			slog.Error("Error building document index", "directory", docsDir, "error", err)
+		} else {
+			slog.Info("Document index built", "directory", docsDir, "excerpts", len(index.Chunks))
+		}
+		if done != nil {
+			done(index, err)
+		}
+	}()
+	return true
+}
+
+// loadDocIndex returns the index for docsDir saved in indexPath. If the docs
+// folder exists but has not been indexed yet, the index is built in the
+// background and no index is returned until it is ready.
+func (bot *Bot) loadDocIndex(ctx context.Context, docsDir, indexPath string) (*docIndex, error) {
+	docIndexMu.Lock()
+	index, ok := docIndexCache[docsDir]
+	docIndexMu.Unlock()
+	if ok {
+		return index, nil
+	}
+
+	content, err := os.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(docsDir); err != nil {
+			return nil, nil
+		}
+		bot.rebuildDocIndex(docsDir, indexPath, nil)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	index = &docIndex{}
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, err
+	}
+	docIndexMu.Lock()
+	docIndexCache[docsDir] = index
+	docIndexMu.Unlock()
+	return index, nil
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// retrieveContext returns the document excerpts most relevant to query,
+// formatted for the model with numbered sources to cite. It returns an empty
+// string when retrieval is disabled or nothing relevant is found.
+func (bot *Bot) retrieveContext(ctx context.Context, conv *Conversation, query string) string {
+	if bot.Config.RAG == nil || bot.Config.RAG.EmbeddingURL == "" {
+		return ""
+	}
+	logger := loggerFrom(ctx)
+
+	index, err := bot.loadDocIndex(ctx, conv.docsDir(), conv.docIndexPath())
+	if err != nil {
+		logger.Error("Error loading document index", "error", err)
+		return ""
+	}
+	if index == nil || len(index.Chunks) == 0 {
+		return ""
+	}
+
+	queryEmbedding, err := bot.embed(ctx, query)
+	if err != nil {
+		logger.Error("Error embedding query", "error", err)
+		return ""
+	}
+
+	type scoredChunk struct {
+		chunk *docChunk
+		score float64
+	}
+	scored := make([]scoredChunk, 0, len(index.Chunks))
+	for i := range index.Chunks {
+		score := cosineSimilarity(queryEmbedding, index.Chunks[i].Embedding)
+		if score >= bot.Config.RAG.MinScore {
+			scored = append(scored, scoredChunk{&index.Chunks[i], score})
+		}
+	}
+	sort.Slice(scored, func(i, j int) bool { return scored[i].score > scored[j].score })
+	if len(scored) > bot.Config.RAG.TopK {
+		scored = scored[:bot.Config.RAG.TopK]
+	}
+	if len(scored) == 0 {
+		return ""
+	}
+
+	sources := make([]string, len(scored))
+	for i, s := range scored {
+		sources[i] = s.chunk.Source
+	}
+	if cited, ok := ctx.Value(sourcesKey).(*docSources); ok {
+		cited.set(sources)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Use the following excerpts from the team's documents to answer if they are relevant. Cite the sources you use by their number, e.g. [1].\n")
+	for i, s := range scored {
+		logger.Debug("Retrieved document excerpt", "source", s.chunk.Source, "score", s.score)
+		fmt.Fprintf(&sb, "\n[%d] %s:\n%s\n", i+1, s.chunk.Source, s.chunk.Text)
+	}
+	return sb.String()
+}
+
+// docSources holds the documents that excerpts sent with a request came
+// from, numbered as in the prompt, so the reply can name them.
+type docSources struct {
+	mu      sync.Mutex
+	sources []string
+}
+
+func withDocSources(ctx context.Context) (context.Context, *docSources) {
+	sources := &docSources{}
+	return context.WithValue(ctx, sourcesKey, sources), sources
+}
+
+func (s *docSources) set(sources []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources = sources
+}
+
+var citationRegexp = regexp.MustCompile(`\[(\d+)\]`)
+
+// cite appends the names of the documents the reply cites by number, or of
+// every document excerpts were sent from if it cites none, so answers can
+// be traced to their files.
+func (s *docSources) cite(reply string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sources) == 0 || reply == "" {
+		return reply
+	}
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, match := range citationRegexp.FindAllStringSubmatch(reply, -1) {
+		if n, err := strconv.Atoi(match[1]); err == nil && n >= 1 && n <= len(s.sources) {
+			add(s.sources[n-1])
+		}
+	}
+	if len(names) == 0 {
+		for _, name := range s.sources {
+			add(name)
+		}
+	}
+	return fmt.Sprintf("%s (Sources: %s)", reply, strings.Join(names, ", "))
+}
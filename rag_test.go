@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunkDocument(t *testing.T) {
+	tests := []struct {
+		name          string
+		text          string
+		size, overlap int
+		want          []string
+	}{
+		{"empty", "\n\n  \n", 100, 0, nil},
+		{"one paragraph", "Hello world.", 100, 0, []string{"Hello world."}},
+		{"paragraphs joined", "One.\n\nTwo.\n  \nThree.", 100, 0, []string{"One.\n\nTwo.\n\nThree."}},
+		{"crlf", "One.\r\n\r\nTwo.", 100, 0, []string{"One.\n\nTwo."}},
+		{"paragraphs split", "aaaa bbbb\n\ncccc dddd", 12, 0, []string{"aaaa bbbb", "cccc dddd"}},
+		{"overlap", "aaaa bbbb\n\ncccc", 12, 5, []string{"aaaa bbbb", "bbbb\n\ncccc"}},
+		{"overlap starts at a word", "aaaa bbbbbb\n\ncc", 14, 5, []string{"aaaa bbbbbb", "cc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chunkDocument(tt.text, tt.size, tt.overlap); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunkDocument() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkDocumentBounds(t *testing.T) {
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 40) +
+		"\n\n" + strings.Repeat("Ünïcödé wörds ärë längër. ", 30) +
+		"\n\n" + strings.Repeat("x", 700)
+	for _, size := range []int{50, 120, 500} {
+		for _, overlap := range []int{0, 20, size} {
+			chunks := chunkDocument(text, size, overlap)
+			if len(chunks) < 2 {
+				t.Errorf("size %d, overlap %d: %d chunks", size, overlap, len(chunks))
+			}
+			for _, chunk := range chunks {
+				if len(chunk) > size {
+					t.Errorf("size %d, overlap %d: chunk of %d bytes", size, overlap, len(chunk))
+				}
+				if !utf8.ValidString(chunk) {
+					t.Errorf("size %d, overlap %d: chunk %q is not valid UTF-8", size, overlap, chunk)
+				}
+			}
+		}
+	}
+}
+
+func TestOverlapTail(t *testing.T) {
+	tests := []struct {
+		chunk string
+		n     int
+		want  string
+	}{
+		{"one two three", 0, ""},
+		{"one two three", 13, ""},
+		{"one two three", 5, "three"},
+		{"one two three", 8, "three"},
+		{"one two three", 9, "two three"},
+		{"one\n\ntwo", 4, "two"},
+		{"onetwothree", 5, ""},
+		{"wörd wörd", 6, "wörd"},
+	}
+	for _, tt := range tests {
+		if got := overlapTail(tt.chunk, tt.n); got != tt.want {
+			t.Errorf("overlapTail(%q, %d) = %q, want %q", tt.chunk, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestDocSourcesCite(t *testing.T) {
+	tests := []struct {
+		sources []string
+		reply   string
+		want    string
+	}{
+		{nil, "Hello.", "Hello."},
+		{[]string{"a.md"}, "", ""},
+		{[]string{"a.md", "b.txt"}, "See [2].", "See [2]. (Sources: b.txt)"},
+		{[]string{"a.md", "b.txt"}, "See [2] and [1] and [2].", "See [2] and [1] and [2]. (Sources: b.txt, a.md)"},
+		{[]string{"a.md", "b.txt"}, "Nothing cited.", "Nothing cited. (Sources: a.md, b.txt)"},
+		{[]string{"a.md", "a.md"}, "Nothing cited.", "Nothing cited. (Sources: a.md)"},
+		{[]string{"a.md"}, "See [3] or [0].", "See [3] or [0]. (Sources: a.md)"},
+	}
+	for _, tt := range tests {
+		_, sources := withDocSources(context.Background())
+		sources.set(tt.sources)
+		if got := sources.cite(tt.reply); got != tt.want {
+			t.Errorf("cite(%q) with %q = %q, want %q", tt.reply, tt.sources, got, tt.want)
+		}
+	}
+}
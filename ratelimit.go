@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets sharing one rate, keyed by nick,
+// hostmask or channel. A limiter with a rate of zero allows everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	if limit != nil && limit.Rate > 0 {
+		l.rate = limit.Rate / 60
+		l.burst = float64(limit.Burst)
+		if l.burst < 1 {
+			l.burst = 1
+		}
+	}
+	return l
+}
+
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= 1024 {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	return b
+}
+
+// prune drops buckets that have refilled completely, since a new bucket
+// would start in the same state.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Allow takes a token for key if one is available.
+func (l *rateLimiter) Allow(key string) bool {
+	return allowBoth(l, key, nil, "")
+}
+
+// allowBoth takes a token from each limiter only if both have one, so a
+// message refused by one limit does not use up the other. The second
+// limiter may be nil.
+func allowBoth(a *rateLimiter, aKey string, b *rateLimiter, bKey string) bool {
+	now := time.Now()
+	var buckets []*tokenBucket
+	for _, l := range []*rateLimiter{a, b} {
+		if l == nil || l.rate == 0 {
+			continue
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		key := aKey
+		if l == b {
+			key = bKey
+		}
+		bucket := l.bucket(key, now)
+		if bucket.tokens < 1 {
+			return false
+		}
+		buckets = append(buckets, bucket)
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true
+}
+
+// Wait blocks until a token for key is available and takes it. The token is
+// reserved before sleeping, so waiting senders go in turn without holding
+// the lock.
+func (l *rateLimiter) Wait(key string) {
+	if l.rate == 0 {
+		return
+	}
+	l.mu.Lock()
+	b := l.bucket(key, time.Now())
+	b.tokens--
+	wait := time.Duration(-b.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit *RateLimit
+		calls int
+		want  int
+	}{
+		{"disabled", nil, 50, 50},
+		{"zero rate", &RateLimit{Rate: 0, Burst: 3}, 50, 50},
+		{"burst", &RateLimit{Rate: 1, Burst: 3}, 10, 3},
+		{"minimum burst", &RateLimit{Rate: 1}, 10, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.limit)
+			allowed := 0
+			for i := 0; i < tt.calls; i++ {
+				if l.Allow("alice") {
+					allowed++
+				}
+			}
+			if allowed != tt.want {
+				t.Errorf("allowed %d of %d calls, want %d", allowed, tt.calls, tt.want)
+			}
+			if tt.want < tt.calls && !l.Allow("bob") {
+				t.Errorf("a different key was refused")
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter(&RateLimit{Rate: 60, Burst: 2})
+	start := time.Now()
+	tests := []struct {
+		after time.Duration
+		take  float64
+		want  float64
+	}{
+		{0, 2, 2},
+		{500 * time.Millisecond, 0, 0.5},
+		{2 * time.Second, 0, 2},
+		{10 * time.Second, 1, 2},
+		{11 * time.Second, 0, 2},
+	}
+	for _, tt := range tests {
+		b := l.bucket("key", start.Add(tt.after))
+		if b.tokens != tt.want {
+			t.Errorf("after %s: %v tokens, want %v", tt.after, b.tokens, tt.want)
+		}
+		b.tokens -= tt.take
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter(&RateLimit{Rate: 60, Burst: 1})
+	now := time.Now()
+	for i := 0; i < 1024; i++ {
+		l.bucket(fmt.Sprint(i), now).tokens = 0
+	}
+	// The first bucket is full again by now; the others have just been used.
+	l.buckets["0"].last = now.Add(-time.Minute)
+	l.bucket("new", now)
+	if _, ok := l.buckets["0"]; ok {
+		t.Errorf("a full bucket was kept")
+	}
+	if len(l.buckets) != 1024 {
+		t.Errorf("%d buckets after pruning, want 1024", len(l.buckets))
+	}
+}
+
+func TestAllowBoth(t *testing.T) {
+	user := newRateLimiter(&RateLimit{Rate: 1, Burst: 2})
+	channel := newRateLimiter(&RateLimit{Rate: 1, Burst: 3})
+
+	tests := []struct {
+		user, channel string
+		want          bool
+	}{
+		{"alice", "#a", true},
+		{"alice", "#a", true},
+		// Alice is out of tokens, so the channel keeps its last one.
+		{"alice", "#a", false},
+		{"bob", "#a", true},
+		{"bob", "#a", false},
+		{"bob", "#b", true},
+	}
+	for i, tt := range tests {
+		if got := allowBoth(user, tt.user, channel, tt.channel); got != tt.want {
+			t.Errorf("call %d: allowBoth(%s, %s) = %v, want %v", i+1, tt.user, tt.channel, got, tt.want)
+		}
+	}
+	if !allowBoth(newRateLimiter(nil), "x", nil, "") {
+		t.Errorf("a disabled limiter refused")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := newRateLimiter(&RateLimit{Rate: 600, Burst: 1})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		l.Wait("out")
+	}
+	// The first token is free, then one every 100ms.
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Errorf("three waits took %s, want about 200ms", elapsed)
+	}
+
+	disabled := newRateLimiter(nil)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		disabled.Wait("out")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("a disabled limiter waited %s", elapsed)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduledJob is an entry in "schedule.json". A job either sends a fixed
+// message, or asks the model to respond to a prompt and sends its reply.
+type ScheduledJob struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Timezone string `json:"timezone"`
+	Channel  string `json:"channel"`
+	Prompt   string `json:"prompt"`
+	Message  string `json:"message"`
+}
+
+// Reminder is a message to send to a user later, created by "!remindme".
+type Reminder struct {
+	User    string    `json:"user"`
+	Channel string    `json:"channel"`
+	Due     time.Time `json:"due"`
+	Text    string    `json:"text"`
+}
+
+// cronSchedule holds the times a standard five field cron expression
+// matches, as bit sets for each field.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+var cronNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	if alias, ok := cronAliases[strings.ToLower(strings.TrimSpace(spec))]; ok {
+		spec = alias
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule '%s' must have 5 fields", spec)
+	}
+
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 mean Sunday.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	// As in cron, a day field starting with "*", such as "*/2", does not
+	// restrict the day.
+	c.domAny = strings.HasPrefix(fields[2], "*")
+	c.dowAny = strings.HasPrefix(fields[4], "*")
+	return &c, nil
+}
+
+// parseCronField parses lists of values, ranges and steps such as
+// "1-5", "*/15" or "mon,wed,fri".
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = parseCronValue(bounds[0]); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = parseCronValue(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string) (int, error) {
+	if v, ok := cronNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s'", s)
+	}
+	return v, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	// As in cron, when both day fields are restricted either may match.
+	if !c.domAny && !c.dowAny {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// loadSchedule reads "schedule.json" from the conversation's profile.
+func loadSchedule(conv *Conversation) ([]ScheduledJob, error) {
+	content, err := os.ReadFile(conv.configFilePath("schedule.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var jobs []ScheduledJob
+	if err := json.Unmarshal(content, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Limits on reminders, so "!remindme" cannot fill reminders.json or be used
+// to flood a channel later.
+const (
+	maxRemindersPerUser = 10
+	maxReminderText     = 400
+	maxReminderDuration = 366 * 24 * time.Hour
+)
+
+var reminderMu sync.Mutex
+
+// getReminderFilePath keeps reminders outside of profile directories, so
+// they are still sent after the profile is changed.
+func getReminderFilePath() string {
+	return getStateFilePath("reminders.json")
+}
+
+func loadReminders() ([]Reminder, error) {
+	content, err := os.ReadFile(getReminderFilePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var reminders []Reminder
+	if err := json.Unmarshal(content, &reminders); err != nil {
+		return nil, err
+	}
+	return reminders, nil
+}
+
+func saveReminders(reminders []Reminder) error {
+	content, err := json.MarshalIndent(reminders, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getReminderFilePath(), content, 0644)
+}
+
+func addReminder(reminder Reminder) error {
+	reminderMu.Lock()
+	defer reminderMu.Unlock()
+	reminders, err := loadReminders()
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, r := range reminders {
+		if strings.EqualFold(r.User, reminder.User) {
+			count++
+		}
+	}
+	if count >= maxRemindersPerUser {
+		return fmt.Errorf("you already have %d reminders", count)
+	}
+	return saveReminders(append(reminders, reminder))
+}
+
+// takeDueReminders removes and returns the reminders due by now.
+func takeDueReminders(now time.Time) ([]Reminder, error) {
+	reminderMu.Lock()
+	defer reminderMu.Unlock()
+	reminders, err := loadReminders()
+	if err != nil || len(reminders) == 0 {
+		return nil, err
+	}
+	var due, pending []Reminder
+	for _, reminder := range reminders {
+		if reminder.Due.After(now) {
+			pending = append(pending, reminder)
+		} else {
+			due = append(due, reminder)
+		}
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+	return due, saveReminders(pending)
+}
+
+var durationPartRegexp = regexp.MustCompile(`(?i)(\d+)\s*(w|d|h|m|s)`)
+var durationRegexp = regexp.MustCompile(`(?i)^(\d+\s*(w|d|h|m|s)\s*)+$`)
+
+// parseReminderDuration parses durations such as "2h", "1d12h" or "90m", of
+// up to maxReminderDuration.
+func parseReminderDuration(s string) (time.Duration, error) {
+	if !durationRegexp.MatchString(s) {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+	units := map[string]time.Duration{
+		"w": 7 * 24 * time.Hour, "d": 24 * time.Hour, "h": time.Hour, "m": time.Minute, "s": time.Second,
+	}
+	var total time.Duration
+	for _, match := range durationPartRegexp.FindAllStringSubmatch(s, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return 0, err
+		}
+		// Checked before multiplying, which could overflow.
+		unit := units[strings.ToLower(match[2])]
+		if n > int(maxReminderDuration/unit) {
+			return 0, fmt.Errorf("duration '%s' is too long", s)
+		}
+		total += time.Duration(n) * unit
+		if total > maxReminderDuration {
+			return 0, fmt.Errorf("duration '%s' is too long", s)
+		}
+	}
+	return total, nil
+}
+
+// runScheduler runs scheduled jobs and sends due reminders until the bot
+// exits. Reminders that fell due while the bot was stopped are sent at once.
+func (ircBot *IRCBot) runScheduler() {
+	lastMinute := time.Now().Truncate(time.Minute)
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		reminders, err := takeDueReminders(now)
+		if err != nil {
+			slog.Error("Error loading reminders", "error", err)
+		}
+		for _, reminder := range reminders {
+			go ircBot.sendReminder(reminder)
+		}
+
+		if minute := now.Truncate(time.Minute); minute.After(lastMinute) {
+			lastMinute = minute
+			ircBot.runScheduledJobs(minute)
+		}
+		<-ticker.C
+	}
+}
+
+func (ircBot *IRCBot) sendReminder(reminder Reminder) {
+	channel := reminder.Channel
+	if channel == "" {
+		channel = ircBot.Config.Channel
+	}
+	ircBot.sendReply(channel, reminder.User, "Reminder: "+reminder.Text)
+}
+
+// scheduleTargets returns the conversations whose profile's schedule is
+// run, grouped by schedule file: the channel in config.json, and channels
+// with a profile selected with "!profile". Jobs without a channel post to
+// every channel of their group.
+func (ircBot *IRCBot) scheduleTargets() map[string][]*Conversation {
+	channels := []string{ircBot.Config.Channel}
+	for target := range activeProfiles() {
+		if isChannel(target) && !strings.EqualFold(target, ircBot.Config.Channel) {
+			channels = append(channels, target)
+		}
+	}
+	targets := make(map[string][]*Conversation)
+	for _, channel := range channels {
+		conv := ircBot.conversation(channel)
+		path := conv.configFilePath("schedule.json")
+		targets[path] = append(targets[path], conv)
+	}
+	return targets
+}
+
+func (ircBot *IRCBot) runScheduledJobs(minute time.Time) {
+	for _, convs := range ircBot.scheduleTargets() {
+		jobs, err := loadSchedule(convs[0])
+		if err != nil {
+			slog.Error("Error loading schedule", "profile", convs[0].profileLabel(), "error", err)
+			continue
+		}
+		ircBot.runDueJobs(jobs, convs, minute)
+	}
+}
+
+func (ircBot *IRCBot) runDueJobs(jobs []ScheduledJob, convs []*Conversation, minute time.Time) {
+	for _, job := range jobs {
+		schedule, err := parseCron(job.Schedule)
+		if err != nil {
+			slog.Error("Invalid schedule", "job", job.Name, "error", err)
+			continue
+		}
+		t := minute
+		if job.Timezone != "" {
+			location, err := time.LoadLocation(job.Timezone)
+			if err != nil {
+				slog.Error("Invalid time zone", "job", job.Name, "error", err)
+				continue
+			}
+			t = minute.In(location)
+		}
+		if !schedule.matches(t) {
+			continue
+		}
+		channels := []string{job.Channel}
+		if job.Channel == "" {
+			channels = channels[:0]
+			for _, conv := range convs {
+				channels = append(channels, conv.Target)
+			}
+		}
+		// Jobs only post where the bot already is, so a schedule cannot
+		// make it join channels.
+		for _, channel := range channels {
+			if !ircBot.inChannel(channel) {
+				slog.Debug("Skipped scheduled job for a channel Nisaba is not in", "job", job.Name, "channel", channel)
+				continue
+			}
+			go ircBot.runScheduledJob(job, channel)
+		}
+	}
+}
+
+func (ircBot *IRCBot) runScheduledJob(job ScheduledJob, channel string) {
+	ctx := withRequestID(context.Background())
+	logger := loggerFrom(ctx).With("job", job.Name)
+
+	if job.Prompt == "" {
+		logger.Info("Running scheduled job", "channel", channel)
+		ircBot.sendReply(channel, "", job.Message)
+		return
+	}
+
+	// Wait for any conversation in progress rather than skipping the job.
+	for waited := time.Duration(0); !ircBot.IsAvailable; waited += 5 * time.Second {
+		if waited >= 5*time.Minute {
+			logger.Warn("Skipped scheduled job while busy")
+			return
+		}
+		time.Sleep(5 * time.Second)
+	}
+	logger.Info("Running scheduled job", "channel", channel, "prompt", job.Prompt)
+	ircBot.IsAvailable = false
+	response, err := ircBot.runJobPrompt(ctx, ircBot.conversation(channel), job.Prompt)
+	ircBot.IsAvailable = true
+	if err != nil {
+		logger.Error("Error generating scheduled response", "error", err)
+		return
+	}
+	if job.Message != "" {
+		response = job.Message + " " + response
+	}
+	ircBot.sendReply(channel, "", response)
+}
+
+// runJobPrompt answers a job's prompt with the channel's system prompt. Like
+// trigger prompts, it does not use or change the message history, which
+// would otherwise hold a prompt nobody in the channel wrote.
+func (ircBot *IRCBot) runJobPrompt(ctx context.Context, conv *Conversation, prompt string) (string, error) {
+	var messages []Message
+	if systemPrompt := loadSystemPrompt(conv); systemPrompt != "" {
+		messages = append(messages, Message{Role: "system", Content: systemPrompt})
+	}
+	response, err := ircBot.complete(ctx, conv, append(messages, Message{Role: "user", Content: prompt}))
+	if err != nil {
+		return "", err
+	}
+	response, _ = ircBot.moderate(ctx, conv, "output", "", response)
+	return response, nil
+}
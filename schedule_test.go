@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"0 9 * * mon-fri", false},
+		{"*/15 * * * *", false},
+		{"0,30 8-18/2 1 jan,jul 0", false},
+		{"@hourly", false},
+		{"@DAILY", false},
+		{"0 0 * * 7", false},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+		{"*/x * * * *", true},
+		{"foo * * * *", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCron(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(1, 0, 0), true},
+		{"0 9 * * mon-fri", at(1, 9, 0), true},
+		{"0 9 * * mon-fri", at(1, 9, 1), false},
+		{"0 9 * * mon-fri", at(6, 9, 0), false},
+		{"*/15 * * * *", at(1, 12, 45), true},
+		{"*/15 * * * *", at(1, 12, 50), false},
+		{"10/20 * * * *", at(1, 12, 30), true},
+		{"10/20 * * * *", at(1, 12, 20), false},
+		{"0 0 * * 0", at(7, 0, 0), true},
+		{"0 0 * * 7", at(7, 0, 0), true},
+		{"0 0 * * sun", at(8, 0, 0), false},
+		{"@monthly", at(1, 0, 0), true},
+		{"@monthly", at(2, 0, 0), false},
+		{"0 0 * feb *", at(1, 0, 0), false},
+		// When both day fields are restricted either one may match.
+		{"0 0 15 * mon", at(8, 0, 0), true},
+		{"0 0 15 * mon", at(15, 0, 0), true},
+		{"0 0 15 * mon", at(16, 0, 0), false},
+		// A day field starting with "*" is not a restriction.
+		{"0 0 */2 * mon", at(3, 0, 0), false},
+		{"0 0 */2 * mon", at(15, 0, 0), true},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.spec, err)
+		}
+		if got := schedule.matches(tt.t); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.spec, tt.t.Format("Mon 2006-01-02 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestParseReminderDuration(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"2h", 2 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"1d12h", 36 * time.Hour, false},
+		{"1w", 7 * 24 * time.Hour, false},
+		{"1H 30M", 90 * time.Minute, false},
+		{"45s", 45 * time.Second, false},
+		{"366d", maxReminderDuration, false},
+		{"367d", 0, true},
+		{"53w", 0, true},
+		{"365d25h", 0, true},
+		{"99999999999999999999h", 0, true},
+		{"9223372036854775807s", 0, true},
+		{"", 0, true},
+		{"h", 0, true},
+		{"2x", 0, true},
+		{"-1h", 0, true},
+		{"2h later", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseReminderDuration(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseReminderDuration(%q) error = %v, want error %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseReminderDuration(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
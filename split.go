@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ircMaxLine is the maximum length of an IRC line in bytes, including the
+// sender prefix, the command and the trailing CRLF.
+const ircMaxLine = 512
+
+// paragraphBreak is sent in place of a blank line between paragraphs, since
+// IRC servers do not relay empty messages.
+const paragraphBreak = " "
+
+// keptBlankLine stands for a blank line that must be kept, such as one in a
+// code block, so it is not taken for the end of a paragraph. It is sent as
+// paragraphBreak whether or not paragraphs are preserved.
+const keptBlankLine = "\x00"
+
+var (
+	paragraphRegexp = regexp.MustCompile(`\n[ \t]*\n\s*`)
+	sentenceRegexp  = regexp.MustCompile(`[.!?\x{2026}]["')\]]*\s+`)
+)
+
+// splitMessage splits a response into lines of at most maxSize bytes. Lines
+// are broken at sentence ends where possible, then at spaces, and never inside
+// a UTF-8 sequence or grapheme cluster. When marker is true every line but
+// the blank ones between paragraphs ends with a "(1/4)" style continuation
+// marker, counted against maxSize.
+func splitMessage(response string, maxSize int, preserveParagraphs, marker bool) []string {
+	response = strings.ReplaceAll(response, "\r\n", "\n")
+	response = strings.TrimSpace(response)
+	if response == "" || maxSize < 1 {
+		return nil
+	}
+
+	reserve := 0
+	for {
+		var parts []string
+		for i, paragraph := range paragraphRegexp.Split(response, -1) {
+			if i > 0 && preserveParagraphs {
+				parts = append(parts, paragraphBreak)
+			}
+			for _, line := range strings.Split(paragraph, "\n") {
+				if line == keptBlankLine {
+					parts = append(parts, paragraphBreak)
+					continue
+				}
+				parts = append(parts, splitLine(line, maxSize-reserve)...)
+			}
+		}
+		if !marker || len(parts) < 2 {
+			return parts
+		}
+
+		// Blank lines between paragraphs are not numbered.
+		count := 0
+		for _, part := range parts {
+			if part != paragraphBreak {
+				count++
+			}
+		}
+		if count < 2 {
+			return parts
+		}
+
+		// The marker width depends on the number of parts, so split again
+		// if the reserved space turns out to be too small.
+		width := len(fmt.Sprintf(" (%d/%d)", count, count))
+		if width > reserve {
+			reserve = width
+			if reserve >= maxSize {
+				return parts
+			}
+			continue
+		}
+		n := 0
+		for i, part := range parts {
+			if part != paragraphBreak {
+				n++
+				parts[i] = fmt.Sprintf("%s (%d/%d)", part, n, count)
+			}
+		}
+		return parts
+	}
+}
+
+func splitLine(line string, maxSize int) []string {
+	var parts []string
+	line = strings.TrimRightFunc(line, unicode.IsSpace)
+	for len(line) > maxSize {
+		cut := findCut(line, maxSize)
+		if part := strings.TrimRightFunc(line[:cut], unicode.IsSpace); part != "" {
+			parts = append(parts, part)
+		}
+		line = strings.TrimLeftFunc(line[cut:], unicode.IsSpace)
+	}
+	if strings.TrimSpace(line) != "" {
+		parts = append(parts, line)
+	}
+	return parts
+}
+
+// findCut returns the byte offset at which to break line so the first part
+// fits in maxSize. Sentence and word breaks are only used when they keep at
+// least half of the available space, to avoid very short lines.
+func findCut(line string, maxSize int) int {
+	boundaries := graphemeBoundaries(line[:windowEnd(line, maxSize)])
+	limit := 0
+	for _, b := range boundaries {
+		if b > maxSize {
+			break
+		}
+		limit = b
+	}
+	if limit == 0 {
+		// A single grapheme cluster larger than maxSize cannot be kept whole.
+		limit = maxSize
+		for limit > 0 && !utf8.RuneStart(line[limit]) {
+			limit--
+		}
+		if limit == 0 {
+			_, limit = utf8.DecodeRuneInString(line)
+		}
+		return limit
+	}
+
+	window := line[:limit]
+	minimum := limit / 2
+	if matches := sentenceRegexp.FindAllStringIndex(window, -1); len(matches) > 0 {
+		if end := matches[len(matches)-1][1]; end >= minimum {
+			return end
+		}
+	}
+	if i := strings.LastIndexFunc(window, unicode.IsSpace); i >= minimum {
+		return i + 1
+	}
+	return limit
+}
+
+// windowEnd returns the end of the first whole rune that starts at or after
+// maxSize, which is as far as line must be examined to tell whether maxSize
+// itself falls inside a grapheme cluster.
+func windowEnd(line string, maxSize int) int {
+	end := maxSize
+	for end < len(line) && !utf8.RuneStart(line[end]) {
+		end++
+	}
+	if end < len(line) {
+		_, size := utf8.DecodeRuneInString(line[end:])
+		end += size
+	}
+	return end
+}
+
+// graphemeBoundaries returns the byte offsets in s at which a line may be
+// broken without splitting a user-perceived character. It covers combining
+// marks, variation selectors, emoji modifiers, zero width joiner sequences
+// and regional indicator pairs.
+func graphemeBoundaries(s string) []int {
+	var boundaries []int
+	var prev rune
+	regional := 0
+	for i, r := range s {
+		if i > 0 && !extendsGrapheme(prev, r, regional) {
+			boundaries = append(boundaries, i)
+		}
+		if isRegionalIndicator(r) {
+			regional++
+		} else {
+			regional = 0
+		}
+		prev = r
+	}
+	return append(boundaries, len(s))
+}
+
+func extendsGrapheme(prev, r rune, regional int) bool {
+	switch {
+	case prev == '\r' && r == '\n':
+		return true
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+		return true
+	case r == '\u200d' || prev == '\u200d':
+		return true
+	case r >= '\ufe00' && r <= '\ufe0f':
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		return true
+	case r >= 0xe0020 && r <= 0xe007f:
+		return true
+	case isRegionalIndicator(r) && regional%2 == 1:
+		return true
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name               string
+		response           string
+		maxSize            int
+		preserveParagraphs bool
+		marker             bool
+		want               []string
+	}{
+		{"empty", "  \n ", 20, false, false, nil},
+		{"no room", "hello", 0, false, false, nil},
+		{"short", "hello world", 20, false, false, []string{"hello world"}},
+		{"lines", "one\ntwo\r\nthree", 20, false, false, []string{"one", "two", "three"}},
+		{"word break", "the quick brown fox jumps", 10, false, false, []string{"the quick", "brown fox", "jumps"}},
+		{"sentence break", "Hi there. This is long.", 16, false, false, []string{"Hi there.", "This is long."}},
+		{"long word", "abcdefghij", 4, false, false, []string{"abcd", "efgh", "ij"}},
+		{"paragraphs dropped", "one\n\ntwo", 20, false, false, []string{"one", "two"}},
+		{"paragraphs kept", "one\n\n\ntwo", 20, true, false, []string{"one", paragraphBreak, "two"}},
+		{"kept blank line", "a\n" + keptBlankLine + "\nb", 20, false, false, []string{"a", paragraphBreak, "b"}},
+		{"marker", "one\ntwo\nthree", 20, false, true, []string{"one (1/3)", "two (2/3)", "three (3/3)"}},
+		{"marker single line", "one", 20, false, true, []string{"one"}},
+		{"marker skips breaks", "one\n\ntwo", 20, true, true, []string{"one (1/2)", paragraphBreak, "two (2/2)"}},
+		{"marker fits", "aaaa bbbb cccc", 10, false, true, []string{"aaaa (1/3)", "bbbb (2/3)", "cccc (3/3)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMessage(tt.response, tt.maxSize, tt.preserveParagraphs, tt.marker)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitMessage(%q, %d) = %q, want %q", tt.response, tt.maxSize, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMessageKeepsCharacters(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		maxSize int
+	}{
+		{"multibyte", strings.Repeat("日本語のテキスト", 20), 50},
+		{"combining marks", strings.Repeat("é", 40), 7},
+		{"emoji sequence", strings.Repeat("👩‍👩‍👧 ", 10), 30},
+		{"flags", strings.Repeat("🇫🇷🇩🇪", 10), 17},
+		{"skin tone", strings.Repeat("👍🏽", 10), 9},
+		{"mixed", "Grüße aus Köln! " + strings.Repeat("ü", 30) + " done.", 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitMessage(tt.text, tt.maxSize, false, false)
+			var joined strings.Builder
+			for _, part := range parts {
+				if len(part) > tt.maxSize {
+					t.Errorf("part %q is %d bytes, more than %d", part, len(part), tt.maxSize)
+				}
+				if !utf8.ValidString(part) {
+					t.Errorf("part %q is not valid UTF-8", part)
+				}
+				if r, _ := utf8.DecodeRuneInString(part); extendsGrapheme('a', r, 0) && r != ' ' {
+					t.Errorf("part %q starts inside a grapheme cluster", part)
+				}
+				joined.WriteString(part)
+			}
+			if strip := func(s string) string { return strings.Join(strings.Fields(s), "") }; strip(joined.String()) != strip(tt.text) {
+				t.Errorf("parts %q do not add up to the text", parts)
+			}
+		})
+	}
+}
+
+func TestFindCut(t *testing.T) {
+	tests := []struct {
+		line    string
+		maxSize int
+		want    int
+	}{
+		{"hello world", 8, 6},
+		{"First one. Second one", 14, 11},
+		// A sentence break keeping less than half the space is not used.
+		{"Hi. Then more words", 12, 9},
+		{"a b cdefghijkl", 10, 10},
+		{"abcdefghij", 4, 4},
+		{"ééééé", 3, 2},
+		{"ééé", 4, 3},
+		{"🇫🇷🇩🇪", 9, 8},
+	}
+	for _, tt := range tests {
+		if got := findCut(tt.line, tt.maxSize); got != tt.want {
+			t.Errorf("findCut(%q, %d) = %d, want %d", tt.line, tt.maxSize, got, tt.want)
+		}
+	}
+}
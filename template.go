@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// promptTemplate renders the conversation history into a single prompt for
+// the "/completion" endpoint in "query" mode, and lists the stop sequences
+// that end the model's turn in that format.
+type promptTemplate struct {
+	Text string
+	Stop []string
+}
+
+var promptTemplates = map[string]promptTemplate{
+	"chatml": {
+		Text: `{{range .Messages}}<|im_start|>{{.Role}}
+{{.Content}}<|im_end|>
+{{end}}<|im_start|>assistant
+`,
+		Stop: []string{"<|im_end|>", "<|im_start|>"},
+	},
+	// Llama 2 has no system turn: system messages are placed in a <<SYS>>
+	// block at the start of the next user turn.
+	"llama2": {
+		Text: `{{$sys := ""}}{{range .Messages}}{{if eq .Role "system"}}{{$sys = printf "%s%s\n" $sys .Content}}{{else if eq .Role "user"}}<s>[INST] {{if $sys}}<<SYS>>
+{{$sys}}<</SYS>>
+
+{{end}}{{.Content}} [/INST]{{$sys = ""}}{{else if eq .Role "assistant"}} {{.Content}} </s>{{end}}{{end}}`,
+		Stop: []string{"</s>", "[INST]"},
+	},
+	"llama3": {
+		Text: `<|begin_of_text|>{{range .Messages}}<|start_header_id|>{{.Role}}<|end_header_id|>
+
+{{.Content}}<|eot_id|>{{end}}<|start_header_id|>assistant<|end_header_id|>
+
+`,
+		Stop: []string{"<|eot_id|>", "<|end_of_text|>"},
+	},
+	"alpaca": {
+		Text: `{{range .Messages}}{{if eq .Role "system"}}{{.Content}}
+
+{{else if eq .Role "user"}}### Instruction:
+{{.Content}}
+
+{{else if eq .Role "assistant"}}### Response:
+{{.Content}}
+
+{{end}}{{end}}### Response:
+`,
+		Stop: []string{"### Instruction:"},
+	},
+	"vicuna": {
+		Text: `{{range .Messages}}{{if eq .Role "system"}}{{.Content}}
+
+{{else if eq .Role "user"}}USER: {{.Content}}
+{{else if eq .Role "assistant"}}ASSISTANT: {{.Content}}</s>
+{{end}}{{end}}ASSISTANT:`,
+		Stop: []string{"USER:", "</s>"},
+	},
+}
+
+// loadPromptTemplate returns the template named in profile.json, reading
+// "prompttemplate.txt" for the "custom" template. It returns nil if no
+// template is set, in which case only the user's message is sent.
+func loadPromptTemplate(conv *Conversation) (*promptTemplate, error) {
+	name := strings.ToLower(conv.Settings.PromptTemplate)
+	if name == "" {
+		return nil, nil
+	}
+
+	var tmpl promptTemplate
+	if name == "custom" {
+		content, err := os.ReadFile(conv.configFilePath("prompttemplate.txt"))
+		if err != nil {
+			return nil, fmt.Errorf("reading custom prompt template: %w", err)
+		}
+		tmpl.Text = string(content)
+	} else {
+		builtin, ok := promptTemplates[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown prompt template '%s'", conv.Settings.PromptTemplate)
+		}
+		tmpl = builtin
+	}
+	if conv.Settings.Stop != nil {
+		tmpl.Stop = conv.Settings.Stop
+	}
+	return &tmpl, nil
+}
+
+func (t *promptTemplate) render(messages []Message) (string, error) {
+	parsed, err := template.New("prompt").Parse(t.Text)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := parsed.Execute(&sb, struct{ Messages []Message }{messages}); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPromptTemplateRender(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello!"},
+		{Role: "user", Content: "Bye"},
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"chatml", "<|im_start|>system\nBe brief.<|im_end|>\n" +
+			"<|im_start|>user\nHi<|im_end|>\n" +
+			"<|im_start|>assistant\nHello!<|im_end|>\n" +
+			"<|im_start|>user\nBye<|im_end|>\n" +
+			"<|im_start|>assistant\n"},
+		{"llama2", "<s>[INST] <<SYS>>\nBe brief.\n<</SYS>>\n\nHi [/INST] Hello! </s>" +
+			"<s>[INST] Bye [/INST]"},
+		{"llama3", "<|begin_of_text|>" +
+			"<|start_header_id|>system<|end_header_id|>\n\nBe brief.<|eot_id|>" +
+			"<|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|>" +
+			"<|start_header_id|>assistant<|end_header_id|>\n\nHello!<|eot_id|>" +
+			"<|start_header_id|>user<|end_header_id|>\n\nBye<|eot_id|>" +
+			"<|start_header_id|>assistant<|end_header_id|>\n\n"},
+		{"alpaca", "Be brief.\n\n### Instruction:\nHi\n\n### Response:\nHello!\n\n" +
+			"### Instruction:\nBye\n\n### Response:\n"},
+		{"vicuna", "Be brief.\n\nUSER: Hi\nASSISTANT: Hello!</s>\nUSER: Bye\nASSISTANT:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := promptTemplates[tt.name]
+			got, err := tmpl.render(messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLlama2SystemMessages(t *testing.T) {
+	tmpl := promptTemplates["llama2"]
+	got, err := tmpl.render([]Message{
+		{Role: "system", Content: "One."},
+		{Role: "system", Content: "Two."},
+		{Role: "user", Content: "Hi"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<s>[INST] <<SYS>>\nOne.\nTwo.\n<</SYS>>\n\nHi [/INST]"; got != want {
+		t.Errorf("render() = %q, want %q", got, want)
+	}
+}
+
+func TestLoadPromptTemplate(t *testing.T) {
+	dir := t.TempDir()
+	oldConfigDir := configDir
+	configDir = dir
+	t.Cleanup(func() { configDir = oldConfigDir })
+	if err := os.WriteFile(filepath.Join(dir, "prompttemplate.txt"), []byte("{{range .Messages}}{{.Content}}{{end}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		settings ProfileSettings
+		wantNil  bool
+		wantStop []string
+		wantErr  bool
+	}{
+		{ProfileSettings{}, true, nil, false},
+		{ProfileSettings{PromptTemplate: "ChatML"}, false, []string{"<|im_end|>", "<|im_start|>"}, false},
+		{ProfileSettings{PromptTemplate: "llama3", Stop: []string{"END"}}, false, []string{"END"}, false},
+		{ProfileSettings{PromptTemplate: "custom"}, false, nil, false},
+		{ProfileSettings{PromptTemplate: "mistral"}, false, nil, true},
+	}
+	for _, tt := range tests {
+		tmpl, err := loadPromptTemplate(&Conversation{Settings: tt.settings})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("loadPromptTemplate(%q) error = %v, want error %v", tt.settings.PromptTemplate, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if (tmpl == nil) != tt.wantNil {
+			t.Errorf("loadPromptTemplate(%q) = %v", tt.settings.PromptTemplate, tmpl)
+			continue
+		}
+		if tmpl != nil && !reflect.DeepEqual(tmpl.Stop, tt.wantStop) {
+			t.Errorf("loadPromptTemplate(%q) stop = %q, want %q", tt.settings.PromptTemplate, tmpl.Stop, tt.wantStop)
+		}
+	}
+
+	tmpl, err := loadPromptTemplate(&Conversation{Settings: ProfileSettings{PromptTemplate: "custom"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tmpl.render([]Message{{Role: "user", Content: "a"}, {Role: "user", Content: "b"}}); err != nil || got != "ab" {
+		t.Errorf("custom render() = %q, %v", got, err)
+	}
+
+	// The built-in templates must not be changed by a profile's stop list.
+	if stop := promptTemplates["llama3"].Stop; stop[0] != "<|eot_id|>" {
+		t.Errorf("llama3 stop changed to %q", stop)
+	}
+
+	configDir = t.TempDir()
+	if _, err := loadPromptTemplate(&Conversation{Settings: ProfileSettings{PromptTemplate: "custom"}}); err == nil {
+		t.Errorf("a missing custom template was accepted")
+	}
+}
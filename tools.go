@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ToolCall is an OpenAI-style request from the model to run a tool.
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// Tool is a Go function the model may call. Parameters is the JSON schema of
+// the arguments object passed to Run.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+	Run         func(ctx context.Context, conv *Conversation, args json.RawMessage) (string, error)
+}
+
+var toolRegistry = make(map[string]*Tool)
+
+func registerTool(tool *Tool) {
+	if _, exists := toolRegistry[tool.Name]; exists {
+		panic(fmt.Sprintf("tool '%s' registered twice", tool.Name))
+	}
+	toolRegistry[tool.Name] = tool
+}
+
+// allowedTools returns the tools enabled for a channel, or a nickname for
+// direct messages, in the "tools" config, falling back to the "*" entry. The name "*" in a list allows every tool.
+func (bot *Bot) allowedTools(channel string) map[string]*Tool {
+	names, ok := bot.Config.Tools[channel]
+	if !ok {
+		names = bot.Config.Tools["*"]
+	}
+
+	tools := make(map[string]*Tool)
+	for _, name := range names {
+		if name == "*" {
+			for toolName, tool := range toolRegistry {
+				tools[toolName] = tool
+			}
+		} else if tool, ok := toolRegistry[name]; ok {
+			tools[name] = tool
+		}
+	}
+	return tools
+}
+
+func toolDefinitions(tools map[string]*Tool) []map[string]interface{} {
+	names := make([]string, 0, len(tools))
+	for name := range tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		tool := tools[name]
+		definitions = append(definitions, map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        tool.Name,
+				"description": tool.Description,
+				"parameters":  tool.Parameters,
+			},
+		})
+	}
+	return definitions
+}
+
+// runToolCall runs a tool requested by the model and returns the result as a
+// message with the "tool" role. Failures are reported to the model in the
+// result rather than ending the conversation.
+func runToolCall(ctx context.Context, conv *Conversation, tools map[string]*Tool, call ToolCall) Message {
+	logger := loggerFrom(ctx).With("tool", call.Function.Name, "tool_call_id", call.ID)
+	result := Message{Role: "tool", ToolCallID: call.ID, Name: call.Function.Name}
+
+	tool, ok := tools[call.Function.Name]
+	if !ok {
+		logger.Warn("Model requested a tool that is not allowed")
+		result.Content = fmt.Sprintf("Error: the tool '%s' is not available.", call.Function.Name)
+		return result
+	}
+
+	args := json.RawMessage(call.Function.Arguments)
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	logger.Info("Running tool", "arguments", call.Function.Arguments)
+	output, err := tool.Run(ctx, conv, args)
+	if err != nil {
+		logger.Warn("Tool returned an error", "error", err)
+		result.Content = fmt.Sprintf("Error: %v", err)
+		return result
+	}
+	result.Content = output
+	return result
+}
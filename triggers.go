@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/thoj/go-ircevent"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Trigger is an entry in "triggers.json". It reacts to an IRC event, or to
+// channel messages matching Pattern that are not addressed to the bot, by
+// sending Message or the model's reply to Prompt. Both are Go templates.
+type Trigger struct {
+	Name     string `json:"name"`
+	Event    string `json:"event"`
+	Channel  string `json:"channel"`
+	Pattern  string `json:"pattern"`
+	Message  string `json:"message"`
+	Prompt   string `json:"prompt"`
+	Cooldown int    `json:"cooldown"`
+	PerUser  bool   `json:"per_user"`
+
+	pattern *regexp.Regexp
+	message *template.Template
+	prompt  *template.Template
+}
+
+// triggerEvent is the data available to trigger templates.
+type triggerEvent struct {
+	Nick    string
+	Channel string
+	Text    string
+	Target  string
+	Match   []string
+}
+
+// defaultTriggerCooldown is the cooldown, in seconds, of triggers without
+// one, so a trigger cannot be made to flood the channel.
+const defaultTriggerCooldown = 60
+
+var triggerEvents = map[string]bool{"join": true, "part": true, "topic": true, "kick": true, "message": true}
+
+// triggerFile is a parsed "triggers.json" and its modification time.
+type triggerFile struct {
+	modTime  time.Time
+	triggers []*Trigger
+}
+
+var (
+	triggerMu        sync.Mutex
+	triggerFiles     = make(map[string]*triggerFile)
+	triggerLastFired = make(map[string]time.Time)
+)
+
+func parseTriggers(content []byte) ([]*Trigger, error) {
+	var triggers []*Trigger
+	if err := json.Unmarshal(content, &triggers); err != nil {
+		return nil, err
+	}
+	for i, t := range triggers {
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("trigger %d", i+1)
+		}
+		t.Event = strings.ToLower(t.Event)
+		if !triggerEvents[t.Event] {
+			return nil, fmt.Errorf("%s: unknown event '%s'", t.Name, t.Event)
+		}
+		if t.Message == "" && t.Prompt == "" {
+			return nil, fmt.Errorf("%s: either message or prompt is required", t.Name)
+		}
+		if t.Cooldown < 1 {
+			t.Cooldown = defaultTriggerCooldown
+		}
+		var err error
+		if t.Pattern != "" {
+			if t.pattern, err = regexp.Compile(t.Pattern); err != nil {
+				return nil, fmt.Errorf("%s: %w", t.Name, err)
+			}
+		} else if t.Event == "message" {
+			return nil, fmt.Errorf("%s: message triggers require a pattern", t.Name)
+		}
+		if t.Message != "" {
+			if t.message, err = template.New(t.Name).Parse(t.Message); err != nil {
+				return nil, fmt.Errorf("%s: %w", t.Name, err)
+			}
+		}
+		if t.Prompt != "" {
+			if t.prompt, err = template.New(t.Name).Parse(t.Prompt); err != nil {
+				return nil, fmt.Errorf("%s: %w", t.Name, err)
+			}
+		}
+	}
+	return triggers, nil
+}
+
+// loadTriggers returns the triggers for the conversation's profile. The file
+// is only parsed again when it changes, as it is read for every channel
+// message.
+func loadTriggers(conv *Conversation) ([]*Trigger, error) {
+	path := conv.configFilePath("triggers.json")
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	triggerMu.Lock()
+	defer triggerMu.Unlock()
+	if cached, ok := triggerFiles[path]; ok && info.ModTime().Equal(cached.modTime) {
+		return cached.triggers, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	triggers, err := parseTriggers(content)
+	if err != nil {
+		return nil, err
+	}
+	triggerFiles[path] = &triggerFile{modTime: info.ModTime(), triggers: triggers}
+	return triggers, nil
+}
+
+// cooldownKey identifies the trigger of a profile in a channel, and for a
+// user if the cooldown is per user.
+func (t *Trigger) cooldownKey(profile, channel, nick string) string {
+	key := profile + "\x00" + strings.ToLower(channel) + "\x00" + t.Name
+	if t.PerUser {
+		key += "\x00" + strings.ToLower(nick)
+	}
+	return key
+}
+
+// coolingDown reports whether the trigger fired too recently.
+func (t *Trigger) coolingDown(key string) bool {
+	triggerMu.Lock()
+	defer triggerMu.Unlock()
+	last, ok := triggerLastFired[key]
+	return ok && time.Since(last) < time.Duration(t.Cooldown)*time.Second
+}
+
+// markFired records that the trigger is firing now.
+func (t *Trigger) markFired(key string) {
+	triggerMu.Lock()
+	defer triggerMu.Unlock()
+	triggerLastFired[key] = time.Now()
+}
+
+// handleTriggerEvent runs the triggers of the channel's profile for an IRC
+// event. Events caused by the bot itself and by blocked users are ignored.
+func (ircBot *IRCBot) handleTriggerEvent(eventType string, e *irc.Event) {
+	if e.Nick == ircBot.IRCConnection.GetNick() || len(e.Arguments) == 0 || !isChannel(e.Arguments[0]) {
+		return
+	}
+	conv := ircBot.conversation(e.Arguments[0])
+	if ircBot.isBlocked(conv, senderFromEvent(e)) {
+		return
+	}
+	event := triggerEvent{Nick: e.Nick, Channel: e.Arguments[0], Text: e.Message()}
+	switch eventType {
+	case "join":
+		event.Text = ""
+	case "kick":
+		if len(e.Arguments) < 2 || e.Arguments[1] == ircBot.IRCConnection.GetNick() {
+			return
+		}
+		event.Target = e.Arguments[1]
+	}
+
+	triggers, err := loadTriggers(conv)
+	if err != nil {
+		slog.Error("Error loading triggers", "error", err)
+		return
+	}
+	type match struct {
+		trigger *Trigger
+		data    triggerEvent
+		key     string
+	}
+	var matches []match
+	for _, t := range triggers {
+		if t.Event != eventType || (t.Channel != "" && !strings.EqualFold(t.Channel, event.Channel)) {
+			continue
+		}
+		data := event
+		if t.pattern != nil {
+			if data.Match = t.pattern.FindStringSubmatch(event.Text); data.Match == nil {
+				continue
+			}
+		}
+		key := t.cooldownKey(conv.Profile, event.Channel, event.Nick)
+		if t.coolingDown(key) {
+			continue
+		}
+		matches = append(matches, match{t, data, key})
+	}
+	if len(matches) == 0 {
+		return
+	}
+	// Triggers answer users like messages do, so they share the same limits.
+	if !ircBot.allowMessage(e, conv) {
+		slog.Info("Throttled trigger", "nick", e.Nick, "host", e.Host, "channel", conv.Target)
+		return
+	}
+	var prompted []match
+	for _, m := range matches {
+		if m.trigger.prompt != nil {
+			prompted = append(prompted, m)
+			continue
+		}
+		m.trigger.markFired(m.key)
+		go ircBot.runTrigger(conv, m.trigger, m.data)
+	}
+	if len(prompted) == 0 {
+		return
+	}
+	// The endpoint answers one request at a time, so prompts wait for it
+	// like messages do, and hold it while they run.
+	if !ircBot.IsAvailable {
+		slog.Info("Skipped triggers while busy", "nick", e.Nick, "channel", conv.Target)
+		return
+	}
+	ircBot.IsAvailable = false
+	for _, m := range prompted {
+		m.trigger.markFired(m.key)
+	}
+	go func() {
+		defer func() { ircBot.IsAvailable = true }()
+		for _, m := range prompted {
+			ircBot.runTrigger(conv, m.trigger, m.data)
+		}
+	}()
+}
+
+func (ircBot *IRCBot) runTrigger(conv *Conversation, t *Trigger, data triggerEvent) {
+	ctx := withRequestID(context.Background())
+	logger := loggerFrom(ctx).With("trigger", t.Name)
+
+	var response string
+	if t.message != nil {
+		var sb strings.Builder
+		if err := t.message.Execute(&sb, data); err != nil {
+			logger.Error("Error rendering trigger message", "error", err)
+			return
+		}
+		response = sb.String()
+	}
+	if t.prompt != nil {
+		// The text comes from the user, so it is moderated like a message.
+		text, stop := ircBot.moderate(ctx, conv, "input", data.Nick, data.Text)
+		if stop {
+			logger.Info("Skipped trigger for moderated message", "nick", data.Nick, "channel", data.Channel)
+			return
+		}
+		if text != data.Text {
+			data.Text = text
+			if t.pattern != nil {
+				if data.Match = t.pattern.FindStringSubmatch(text); data.Match == nil {
+					return
+				}
+			}
+		}
+		var sb strings.Builder
+		if err := t.prompt.Execute(&sb, data); err != nil {
+			logger.Error("Error rendering trigger prompt", "error", err)
+			return
+		}
+		var messages []Message
+		if systemPrompt := loadSystemPrompt(conv); systemPrompt != "" {
+			messages = append(messages, Message{Role: "system", Content: systemPrompt})
+		}
+		reply, err := ircBot.complete(ctx, conv, append(messages, Message{Role: "user", Content: sb.String()}))
+		if err != nil {
+			logger.Error("Error generating trigger response", "error", err)
+			return
+		}
+		reply, _ = ircBot.moderate(ctx, conv, "output", data.Nick, reply)
+		response = strings.TrimSpace(response + " " + reply)
+	}
+	if response == "" {
+		return
+	}
+	logger.Info("Running trigger", "nick", data.Nick, "channel", data.Channel, "response", response)
+	ircBot.sendReply(data.Channel, "", response)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxImagesPerMessage limits how many images from one message are sent.
+const maxImagesPerMessage = 4
+
+var (
+	imageURLRegexp  = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"']+\.(?:png|jpe?g|gif|webp)(?:\?[^\s<>"']*)?`)
+	imageFileRegexp = regexp.MustCompile(`(?i)(?:file://)?(/[^\s<>"']+\.(?:png|jpe?g|gif|webp))`)
+)
+
+var imageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+type imageInput struct {
+	Source   string
+	MIMEType string
+	Data     []byte
+}
+
+func (img imageInput) dataURL() string {
+	return fmt.Sprintf("data:%s;base64,%s", img.MIMEType, base64.StdEncoding.EncodeToString(img.Data))
+}
+
+// payloadMessage is a message whose content is a list of parts rather than
+// plain text, as used for images in the chat API.
+type payloadMessage struct {
+	Message
+	Content interface{} `json:"content"`
+}
+
+func (conv *Conversation) visionEnabled() bool {
+	return conv.Settings.Vision != nil && *conv.Settings.Vision
+}
+
+// findImages downloads the images linked in a message. Local files are only
+// read from directories listed in "image_local_dirs".
+func (bot *Bot) findImages(ctx context.Context, conv *Conversation, text string) []imageInput {
+	if !conv.visionEnabled() {
+		return nil
+	}
+	logger := loggerFrom(ctx)
+
+	var images []imageInput
+	for _, url := range imageURLRegexp.FindAllString(text, maxImagesPerMessage) {
+		img, err := bot.fetchImage(ctx, url)
+		if err != nil {
+			logger.Warn("Error fetching image", "url", url, "error", err)
+			continue
+		}
+		images = append(images, img)
+	}
+	if len(bot.Config.ImageLocalDirs) > 0 {
+		// URLs also contain paths, so only look for files once they are removed.
+		for _, match := range imageFileRegexp.FindAllStringSubmatch(imageURLRegexp.ReplaceAllString(text, ""), -1) {
+			if len(images) >= maxImagesPerMessage {
+				break
+			}
+			img, err := bot.loadLocalImage(match[1])
+			if err != nil {
+				logger.Warn("Error reading image", "path", match[1], "error", err)
+				continue
+			}
+			images = append(images, img)
+		}
+	}
+	if len(images) > maxImagesPerMessage {
+		images = images[:maxImagesPerMessage]
+	}
+	return images
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which net/netip does
+// not count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// checkPublicAddress refuses connections to addresses that are not on the
+// public internet, so links posted by users cannot reach services on the
+// bot's host or network, such as cloud metadata endpoints. It runs after
+// DNS resolution, for every connection including redirects.
+func checkPublicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("address %s is not public", ip)
+	}
+	return nil
+}
+
+// imageClient fetches images linked in messages. It connects directly,
+// without a proxy, so that the address check applies.
+var imageClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkPublicAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme '%s'", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+func (bot *Bot) fetchImage(ctx context.Context, url string) (imageInput, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return imageInput{}, err
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return imageInput{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return imageInput{}, fmt.Errorf("server returned %s", resp.Status)
+	}
+	if resp.ContentLength > int64(*bot.Config.ImageMaxBytes) {
+		return imageInput{}, fmt.Errorf("image is larger than %d bytes", *bot.Config.ImageMaxBytes)
+	}
+	return bot.readImage(url, resp.Body)
+}
+
+// loadLocalImage reads an image from one of the "image_local_dirs". Symbolic
+// links are resolved first, so a link cannot lead outside the directories.
+func (bot *Bot) loadLocalImage(path string) (imageInput, error) {
+	absPath, err := filepath.Abs(filepath.Clean(path))
+	if err != nil {
+		return imageInput{}, err
+	}
+	absPath, err = filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return imageInput{}, err
+	}
+	allowed := false
+	for _, dir := range bot.Config.ImageLocalDirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if absDir, err = filepath.EvalSymlinks(absDir); err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(absDir, absPath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return imageInput{}, fmt.Errorf("path is not in an allowed directory")
+	}
+
+	file, err := os.Open(absPath)
+	if err != nil {
+		return imageInput{}, err
+	}
+	defer file.Close()
+	return bot.readImage(path, file)
+}
+
+// readImage reads at most "image_max_bytes" and checks the content is one of
+// the supported image types, whatever the file name claims.
+func (bot *Bot) readImage(source string, r io.Reader) (imageInput, error) {
+	maxBytes := *bot.Config.ImageMaxBytes
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+	if err != nil {
+		return imageInput{}, err
+	}
+	if len(data) > maxBytes {
+		return imageInput{}, fmt.Errorf("image is larger than %d bytes", maxBytes)
+	}
+	mimeType := http.DetectContentType(data)
+	if !imageTypes[mimeType] {
+		return imageInput{}, fmt.Errorf("unsupported image type '%s'", mimeType)
+	}
+	return imageInput{Source: source, MIMEType: mimeType, Data: data}, nil
+}
+
+// chatImageContent returns the content parts for a chat message with images.
+func chatImageContent(text string, images []imageInput) []map[string]interface{} {
+	parts := []map[string]interface{}{{"type": "text", "text": text}}
+	for _, img := range images {
+		parts = append(parts, map[string]interface{}{
+			"type":      "image_url",
+			"image_url": map[string]interface{}{"url": img.dataURL()},
+		})
+	}
+	return parts
+}
+
+// queryImageData returns the "image_data" for the /completion endpoint, and
+// the "[img-N]" references to place in the prompt.
+func queryImageData(images []imageInput) ([]map[string]interface{}, string) {
+	var data []map[string]interface{}
+	var refs strings.Builder
+	for i, img := range images {
+		id := 10 + i
+		data = append(data, map[string]interface{}{
+			"data": base64.StdEncoding.EncodeToString(img.Data),
+			"id":   id,
+		})
+		fmt.Fprintf(&refs, "[img-%d]", id)
+	}
+	return data, refs.String()
+}
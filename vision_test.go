@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPublicAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:443", true},
+		{"8.8.8.8:80", true},
+		{"[2606:4700::1111]:443", true},
+		{"127.0.0.1:80", false},
+		{"127.1.2.3:8080", false},
+		{"[::1]:80", false},
+		{"10.0.0.1:80", false},
+		{"172.16.5.4:80", false},
+		{"172.32.0.1:80", true},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"100.128.0.1:80", true},
+		{"0.0.0.0:80", false},
+		{"[::]:80", false},
+		{"224.0.0.1:80", false},
+		{"[fe80::1]:80", false},
+		{"[fc00::1]:80", false},
+		{"[ff02::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::ffff:10.1.2.3]:80", false},
+		{"[::ffff:8.8.8.8]:80", true},
+		{"localhost:80", false},
+		{"8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		err := checkPublicAddress("tcp", tt.address, nil)
+		if (err == nil) != tt.public {
+			t.Errorf("checkPublicAddress(%q) = %v, want public %v", tt.address, err, tt.public)
+		}
+	}
+}
+
+func TestLoadLocalImage(t *testing.T) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "images")
+	outside := filepath.Join(root, "private")
+	for _, dir := range []string{allowed, filepath.Join(allowed, "sub"), outside, allowed + "-evil"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	write := func(path string, data []byte) {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(allowed, "a.png"), png)
+	write(filepath.Join(allowed, "sub", "b.png"), png)
+	write(filepath.Join(allowed, "text.png"), []byte("not an image at all"))
+	write(filepath.Join(outside, "secret.png"), png)
+	write(filepath.Join(allowed+"-evil", "c.png"), png)
+	if err := os.Symlink(filepath.Join(outside, "secret.png"), filepath.Join(allowed, "link.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(allowed, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+
+	maxBytes := 1024
+	bot := &Bot{Config: Config{ImageLocalDirs: []string{allowed}, ImageMaxBytes: &maxBytes}}
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{filepath.Join(allowed, "a.png"), true},
+		{filepath.Join(allowed, "sub", "b.png"), true},
+		{filepath.Join(allowed, "sub", "..", "a.png"), true},
+		{filepath.Join(allowed, "text.png"), false},
+		{filepath.Join(allowed, "missing.png"), false},
+		{filepath.Join(outside, "secret.png"), false},
+		{filepath.Join(allowed, "..", "private", "secret.png"), false},
+		{filepath.Join(allowed+"-evil", "c.png"), false},
+		{filepath.Join(allowed, "link.png"), false},
+		{filepath.Join(allowed, "linkdir", "secret.png"), false},
+	}
+	for _, tt := range tests {
+		img, err := bot.loadLocalImage(tt.path)
+		if (err == nil) != tt.ok {
+			t.Errorf("loadLocalImage(%q) error = %v, want ok %v", tt.path, err, tt.ok)
+		}
+		if err == nil && img.MIMEType != "image/png" {
+			t.Errorf("loadLocalImage(%q) type = %q", tt.path, img.MIMEType)
+		}
+	}
+}